@@ -0,0 +1,649 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
+// NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
+
+// AppSpec defines the desired state of App
+// +kubebuilder:validation:XValidation:rule="!has(self.ingress) || has(self.service)",message="spec.ingress requires spec.service"
+type AppSpec struct {
+	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// Image is the container image the workload runs.
+	// +kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+
+	// ImagePullPolicy is the pull policy of the image.
+	// +kubebuilder:validation:Enum=Always;IfNotPresent;Never
+	// +optional
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	// ImagePullSecrets lists the Secrets used to pull the image.
+	// +optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// Replicas is the desired number of pods. Defaults to 1.
+	// It is exposed through the scale subresource, so `kubectl scale` and HorizontalPodAutoscalers can target the App.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=1
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Ports lists the ports exposed by the container.
+	// +optional
+	Ports []corev1.ContainerPort `json:"ports,omitempty"`
+
+	// Env lists the environment variables set in the container.
+	// Changing a ConfigMap or Secret referenced by a value triggers a rolling restart of the App.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// EnvFrom lists ConfigMaps and Secrets whose keys are exposed as environment variables.
+	// Changing a referenced ConfigMap or Secret triggers a rolling restart of the App.
+	// +optional
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+
+	// Volumes lists the volumes of the pod, e.g. ConfigMaps and Secrets mounted as files.
+	// Changing a referenced ConfigMap or Secret triggers a rolling restart of the App.
+	// +optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+
+	// VolumeMounts lists where the volumes are mounted in the container.
+	// +optional
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+
+	// Resources are the compute resources required by the container.
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// LivenessProbe is the liveness probe of the container.
+	// Defaults to a TCP check on the first container port.
+	// +optional
+	LivenessProbe *corev1.Probe `json:"livenessProbe,omitempty"`
+
+	// ReadinessProbe is the readiness probe of the container.
+	// Defaults to a TCP check on the first container port.
+	// +optional
+	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+
+	// Command overrides the image entrypoint.
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// Args are the arguments passed to the entrypoint.
+	// +optional
+	Args []string `json:"args,omitempty"`
+
+	// Service describes the Service exposing the App's pods.
+	// The Service is deleted when this block is removed.
+	// +optional
+	Service *ServiceSpec `json:"service,omitempty"`
+
+	// Ingress describes the Ingress routing external traffic to the App's Service.
+	// It requires spec.service to be set. The Ingress is deleted when this block is removed.
+	// +optional
+	Ingress *IngressSpec `json:"ingress,omitempty"`
+
+	// Autoscaling enables a HorizontalPodAutoscaler for the App. While it is set the
+	// HorizontalPodAutoscaler owns the replica count and spec.replicas is only used as the initial size.
+	// The HorizontalPodAutoscaler is deleted when this block is removed.
+	// +optional
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
+
+	// Strategy describes how a new version of the App replaces the running one.
+	// Defaults to a rolling update of the Deployment.
+	// +optional
+	Strategy *AppStrategy `json:"strategy,omitempty"`
+
+	// ProgressDeadlineSeconds is how long a rollout may take before it is considered failed
+	// and the App is rolled back to its last healthy revision. Defaults to 600.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	ProgressDeadlineSeconds *int32 `json:"progressDeadlineSeconds,omitempty"`
+
+	// RevisionHistoryLimit is the number of old revisions kept to allow a rollback. Defaults to 10.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=10
+	// +optional
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// RollbackTo restores the workload spec of a previous revision. The controller clears it once handled.
+	// +optional
+	RollbackTo *RollbackConfig `json:"rollbackTo,omitempty"`
+
+	// Paused stops the controller from changing the App's child resources, e.g. while they are
+	// hotfixed by hand during an incident. The aloys.tech/paused annotation has the same effect.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
+
+	// DeletionPolicy is what happens to the child and external resources when the App is deleted.
+	// The App is only released once the policy has been applied. Defaults to the default deletion
+	// policy of the operator configuration, Delete unless configured otherwise. Child resources are
+	// the ones labelled aloys.tech/app=<name> with an owner reference to the App.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// RetainKinds lists the kinds of child resources kept when deletionPolicy is Retain.
+	// Defaults to PersistentVolumeClaim.
+	// +kubebuilder:validation:items:Enum=Deployment;Service;Ingress;HorizontalPodAutoscaler;ControllerRevision;PersistentVolumeClaim
+	// +optional
+	RetainKinds []string `json:"retainKinds,omitempty"`
+
+	// DriftPolicy is what the controller does when a child resource is changed outside of the App,
+	// e.g. with `kubectl edit`. The drift is recorded in status.drift and in an Event either way.
+	// Defaults to the default drift policy of the operator configuration, Correct unless
+	// configured otherwise.
+	// +optional
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+}
+
+// DriftPolicy describes what happens when a child resource of an App drifts from the App spec.
+// +kubebuilder:validation:Enum=Correct;Report
+type DriftPolicy string
+
+const (
+	// DriftPolicyCorrect applies the App spec again, reverting the changes made outside of the App.
+	DriftPolicyCorrect DriftPolicy = "Correct"
+	// DriftPolicyReport leaves the changes made outside of the App in place and only reports them.
+	// The next change of the App spec is applied over them.
+	DriftPolicyReport DriftPolicy = "Report"
+)
+
+// DeletionPolicy describes what happens to the resources of an App when it is deleted.
+// +kubebuilder:validation:Enum=Delete;Orphan;Retain
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete deletes the child and external resources of the App.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyOrphan removes the owner references from the child resources, so they survive
+	// the App, and keeps the external resources.
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+	// DeletionPolicyRetain keeps the child resources of the kinds listed in spec.retainKinds
+	// and deletes the others along with the external resources.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+)
+
+// RollbackConfig describes the revision an App is rolled back to.
+type RollbackConfig struct {
+	// Revision is the number of the revision to roll back to. 0 means the revision before the current one.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+}
+
+// AppStrategy describes how a new version of the App is rolled out.
+// +kubebuilder:validation:XValidation:rule="!(has(self.canary) && has(self.blueGreen))",message="canary and blueGreen are mutually exclusive"
+type AppStrategy struct {
+	// Canary runs the new version next to the stable one and shifts replicas to it step by step.
+	// +optional
+	Canary *CanaryStrategy `json:"canary,omitempty"`
+
+	// BlueGreen brings the new version up in a second workload and switches the Service to it once it is fully available.
+	// +optional
+	BlueGreen *BlueGreenStrategy `json:"blueGreen,omitempty"`
+}
+
+// BlueGreenStrategy describes a blue/green rollout.
+type BlueGreenStrategy struct {
+	// ScaleDownDelay is how long the previous color keeps running after the switchover,
+	// so that a rollback only has to switch the Service back. Defaults to 30s.
+	// +optional
+	ScaleDownDelay *metav1.Duration `json:"scaleDownDelay,omitempty"`
+}
+
+// CanaryStrategy describes a canary rollout.
+type CanaryStrategy struct {
+	// Steps are the ordered steps of the rollout. The new version is promoted once the last step completes.
+	// +kubebuilder:validation:MinItems=1
+	Steps []CanaryStep `json:"steps"`
+}
+
+// CanaryStep is one step of a canary rollout.
+type CanaryStep struct {
+	// Weight is the percentage of replicas running the new version during the step.
+	// The Service selects the pods of both versions, so it is also the share of traffic sent to the new version.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	Weight int32 `json:"weight"`
+
+	// Pause is how long the step lasts once the canary pods are available.
+	// When unset, the rollout stays at this step until it is promoted through the aloys.tech/canary-promote annotation.
+	// +optional
+	Pause *metav1.Duration `json:"pause,omitempty"`
+}
+
+// ServiceSpec describes the Service managed for an App.
+type ServiceSpec struct {
+	// Type is the type of the Service. Defaults to ClusterIP.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// Ports lists the ports exposed by the Service.
+	// When empty, every container port is exposed on the same port number.
+	// +optional
+	Ports []corev1.ServicePort `json:"ports,omitempty"`
+
+	// Annotations are added to the Service, e.g. to configure a cloud load balancer.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// IngressSpec describes the Ingress managed for an App.
+type IngressSpec struct {
+	// IngressClassName is the name of the IngressClass handling the Ingress.
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// Hosts lists the hosts routed to the App.
+	// +kubebuilder:validation:MinItems=1
+	Hosts []IngressHost `json:"hosts"`
+
+	// TLS lists the TLS certificates of the hosts.
+	// +optional
+	TLS []IngressTLS `json:"tls,omitempty"`
+
+	// TLSSecretName is the name of the Secret holding the TLS certificate for all hosts.
+	// Deprecated: use tls instead. It is kept so manifests written for v1beta1 keep working.
+	// +optional
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+}
+
+// IngressTLS describes the TLS certificate of a set of hosts.
+type IngressTLS struct {
+	// Hosts lists the hosts covered by the certificate. Defaults to every host of the Ingress.
+	// +optional
+	Hosts []string `json:"hosts,omitempty"`
+
+	// SecretName is the name of the Secret holding the certificate.
+	// +kubebuilder:validation:MinLength=1
+	SecretName string `json:"secretName"`
+}
+
+// IngressHost describes the routing of one host.
+type IngressHost struct {
+	// Host is the fully qualified domain name of the host.
+	Host string `json:"host"`
+
+	// Paths lists the paths routed to the App. Defaults to a single "/" prefix path.
+	// +optional
+	Paths []IngressPath `json:"paths,omitempty"`
+}
+
+// IngressPath describes one path routed to the App's Service.
+type IngressPath struct {
+	// Path is matched against the path of the incoming request. Defaults to "/".
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// PathType determines how Path is matched. Defaults to Prefix.
+	// +kubebuilder:validation:Enum=Exact;Prefix;ImplementationSpecific
+	// +optional
+	PathType *networkingv1.PathType `json:"pathType,omitempty"`
+
+	// Port is the Service port traffic is sent to. Defaults to the first Service port.
+	// +optional
+	Port int32 `json:"port,omitempty"`
+}
+
+// AutoscalingSpec describes the HorizontalPodAutoscaler managed for an App.
+type AutoscalingSpec struct {
+	// MinReplicas is the lower limit of the number of replicas. Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+
+	// MaxReplicas is the upper limit of the number of replicas.
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+
+	// TargetCPUUtilizationPercentage is the target average CPU utilization, relative to the requested CPU.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+
+	// TargetMemoryUtilizationPercentage is the target average memory utilization, relative to the requested memory.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TargetMemoryUtilizationPercentage *int32 `json:"targetMemoryUtilizationPercentage,omitempty"`
+
+	// Metrics lists additional metrics, e.g. pods, object or external metrics, used to compute the replica count.
+	// +optional
+	Metrics []autoscalingv2.MetricSpec `json:"metrics,omitempty"`
+}
+
+// AutoscalingStatus reports the state of the App's HorizontalPodAutoscaler.
+type AutoscalingStatus struct {
+	// CurrentReplicas is the number of replicas last observed by the HorizontalPodAutoscaler.
+	CurrentReplicas int32 `json:"currentReplicas"`
+
+	// DesiredReplicas is the number of replicas last computed by the HorizontalPodAutoscaler.
+	DesiredReplicas int32 `json:"desiredReplicas"`
+}
+
+// AppStatus defines the observed state of App
+type AppStatus struct {
+	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
+	// Important: Run "make" to regenerate code after modifying this file
+
+	// ObservedGeneration is the most recent generation of the App observed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Replicas is the number of pods currently running for the App, ready or not.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// ReadyReplicas is the number of pods of the App that are ready.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// Selector is the label selector of the App's pods in string form, used by the scale subresource.
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
+	// Autoscaling reports the state of the HorizontalPodAutoscaler when spec.autoscaling is set.
+	// +optional
+	Autoscaling *AutoscalingStatus `json:"autoscaling,omitempty"`
+
+	// Phase is a one-word summary of the App's state, computed from its conditions.
+	// +optional
+	Phase AppPhase `json:"phase,omitempty"`
+
+	// Conditions describe the current state of the App: Ready, Progressing and Degraded.
+	// +listType=map
+	// +listMapKey=type
+	// +patchStrategy=merge
+	// +patchMergeKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// URLs lists the URLs the App is reachable at through its Ingress.
+	// +optional
+	URLs []string `json:"urls,omitempty"`
+
+	// Canary reports the progress of the current canary rollout.
+	// +optional
+	Canary *CanaryStatus `json:"canary,omitempty"`
+
+	// BlueGreen reports the active and preview colors when spec.strategy.blueGreen is set.
+	// +optional
+	BlueGreen *BlueGreenStatus `json:"blueGreen,omitempty"`
+
+	// CurrentRevision is the number of the revision matching the current workload spec.
+	// Revisions are recorded in ControllerRevisions named after the App.
+	// +optional
+	CurrentRevision int64 `json:"currentRevision,omitempty"`
+
+	// LastHealthyRevision is the name of the ControllerRevision that was last fully rolled out.
+	// A failed rollout is rolled back to it.
+	// +optional
+	LastHealthyRevision string `json:"lastHealthyRevision,omitempty"`
+
+	// LastRollback reports the last automatic rollback of a failed rollout.
+	// +optional
+	LastRollback *RollbackStatus `json:"lastRollback,omitempty"`
+
+	// ExternalResources lists the resources managed outside the cluster for the App by the
+	// external resource providers registered in the controller, with the IDs they assigned.
+	// +listType=map
+	// +listMapKey=provider
+	// +optional
+	ExternalResources []ExternalResourceStatus `json:"externalResources,omitempty"`
+
+	// Cleanup reports the progress of the cleanup run by the finalizer while the App is being deleted.
+	// +optional
+	Cleanup *CleanupStatus `json:"cleanup,omitempty"`
+
+	// Drift lists the child resources whose fields were changed outside of the App, e.g. with
+	// `kubectl edit`. A reported drift is listed until it is resolved, a corrected drift is kept as
+	// a record until the resource drifts again.
+	// +listType=map
+	// +listMapKey=kind
+	// +listMapKey=name
+	// +optional
+	Drift []ResourceDrift `json:"drift,omitempty"`
+}
+
+// ResourceDrift reports the fields of a child resource that differ from the App spec.
+type ResourceDrift struct {
+	// Kind is the kind of the child resource, e.g. Deployment.
+	Kind string `json:"kind"`
+
+	// Name is the name of the child resource.
+	Name string `json:"name"`
+
+	// Fields lists the fields that differ from the App spec.
+	Fields []FieldDrift `json:"fields"`
+
+	// DetectedAt is when the drift was detected.
+	DetectedAt metav1.Time `json:"detectedAt"`
+
+	// Corrected is true when the fields were reverted to the App spec.
+	// +optional
+	Corrected bool `json:"corrected,omitempty"`
+}
+
+// FieldDrift reports a field of a child resource that differs from the App spec.
+type FieldDrift struct {
+	// Path is the path of the field, e.g. spec.template.spec.containers[name=app].image.
+	Path string `json:"path"`
+
+	// Desired is the value generated from the App spec.
+	// +optional
+	Desired string `json:"desired,omitempty"`
+
+	// Live is the value found on the resource. It is empty when the field was removed.
+	// +optional
+	Live string `json:"live,omitempty"`
+}
+
+// CleanupStatus reports the cleanup of the child and external resources of a deleted App.
+type CleanupStatus struct {
+	// StartTime is when the first cleanup attempt ran.
+	StartTime metav1.Time `json:"startTime"`
+
+	// Attempts is the number of failed cleanup attempts so far. Waiting for the child resources
+	// to be released does not count as an attempt.
+	Attempts int32 `json:"attempts"`
+
+	// LastAttemptTime is when the last failed cleanup attempt ran.
+	// +optional
+	LastAttemptTime *metav1.Time `json:"lastAttemptTime,omitempty"`
+
+	// LastError is the error of the last failed cleanup attempt. It is cleared once the cleanup
+	// succeeds or only waits for the child resources to be released.
+	// +optional
+	LastError string `json:"lastError,omitempty"`
+}
+
+// ExternalResourceStatus reports a resource managed outside the cluster by an external resource provider.
+type ExternalResourceStatus struct {
+	// Provider is the name of the provider managing the resource.
+	Provider string `json:"provider"`
+
+	// ID is the ID the provider assigned to the resource.
+	ID string `json:"id"`
+
+	// Ready is true when the provider reports the resource as usable.
+	Ready bool `json:"ready"`
+
+	// Message describes the state of the resource.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// RollbackStatus reports an automatic rollback.
+type RollbackStatus struct {
+	// FailedRevision is the name of the ControllerRevision whose rollout failed.
+	FailedRevision string `json:"failedRevision"`
+
+	// Revision is the name of the ControllerRevision the App was rolled back to.
+	Revision string `json:"revision"`
+
+	// Reason is why the rollout failed, e.g. CrashLoopBackOff, ImagePullBackOff or ProgressDeadlineExceeded.
+	Reason string `json:"reason"`
+
+	// Message describes the failure, including the last termination message of the failing container.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Time is when the rollback happened.
+	Time metav1.Time `json:"time"`
+}
+
+// BlueGreenStatus reports the colors of a blue/green rollout.
+type BlueGreenStatus struct {
+	// ActiveColor is the color receiving the traffic of the App's Service.
+	// +optional
+	ActiveColor string `json:"activeColor,omitempty"`
+
+	// ActiveRevision is the hash of the pod template of the active color.
+	// +optional
+	ActiveRevision string `json:"activeRevision,omitempty"`
+
+	// PreviewColor is the other color, reachable through the preview Service. It runs the new
+	// version while it is rolling out, and the previous version after the switchover.
+	// +optional
+	PreviewColor string `json:"previewColor,omitempty"`
+
+	// PreviewRevision is the hash of the pod template of the preview color.
+	// +optional
+	PreviewRevision string `json:"previewRevision,omitempty"`
+
+	// ScaleDownAt is when the previous color is scaled down. It is unset while the preview color is rolling out.
+	// +optional
+	ScaleDownAt *metav1.Time `json:"scaleDownAt,omitempty"`
+}
+
+// CanaryStatus reports the progress of a canary rollout.
+type CanaryStatus struct {
+	// Revision is the hash of the pod template being rolled out.
+	Revision string `json:"revision"`
+
+	// CurrentStep is the index of the current step in spec.strategy.canary.steps.
+	CurrentStep int32 `json:"currentStep"`
+
+	// Weight is the weight of the current step.
+	Weight int32 `json:"weight"`
+
+	// StepStartedAt is when the canary pods of the current step became available.
+	// +optional
+	StepStartedAt *metav1.Time `json:"stepStartedAt,omitempty"`
+
+	// Promoted is true once the new version replaced the stable one.
+	// +optional
+	Promoted bool `json:"promoted,omitempty"`
+
+	// Aborted is true when the rollout was aborted. It is not retried until the pod template changes again.
+	// +optional
+	Aborted bool `json:"aborted,omitempty"`
+}
+
+// AppPhase is a one-word summary of the App's state.
+// +kubebuilder:validation:Enum=Pending;Progressing;Running;Degraded;Terminating
+type AppPhase string
+
+const (
+	// AppPhasePending means the workload has no available pods yet.
+	AppPhasePending AppPhase = "Pending"
+	// AppPhaseProgressing means a rollout is in progress.
+	AppPhaseProgressing AppPhase = "Progressing"
+	// AppPhaseRunning means the workload is fully rolled out and available.
+	AppPhaseRunning AppPhase = "Running"
+	// AppPhaseDegraded means the App failed to reconcile or its rollout is stuck.
+	AppPhaseDegraded AppPhase = "Degraded"
+	// AppPhaseTerminating means the App is being deleted.
+	AppPhaseTerminating AppPhase = "Terminating"
+)
+
+// Annotations controlling a canary rollout. The controller removes them once they have been handled.
+const (
+	// AnnotationCanaryPromote promotes the canary immediately, skipping the remaining steps.
+	AnnotationCanaryPromote = "aloys.tech/canary-promote"
+	// AnnotationCanaryAbort aborts the canary and scales the stable version back up.
+	AnnotationCanaryAbort = "aloys.tech/canary-abort"
+)
+
+// AnnotationPaused set to "true" pauses the reconciliation of an App, like spec.paused.
+const AnnotationPaused = "aloys.tech/paused"
+
+// AnnotationForceFinalize lets the finalizer release a deleted App even though its cleanup did not
+// complete, leaving the remaining child and external resources behind. The value is the reason,
+// recorded in a Warning Event together with the state of the cleanup.
+const AnnotationForceFinalize = "aloys.tech/force-finalize"
+
+// Condition types of an App. They follow the kstatus conventions, so
+// `kubectl wait --for=condition=Ready` can be used against an App.
+const (
+	// ConditionReady is True when the workload is fully rolled out and available.
+	ConditionReady = "Ready"
+	// ConditionProgressing is True while the workload is rolling out.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is True when the App failed to reconcile or its rollout is stuck.
+	ConditionDegraded = "Degraded"
+	// ConditionPaused is True while the reconciliation of the App is paused. It is removed once resumed.
+	ConditionPaused = "Paused"
+	// ConditionCleanupStalled is True when the cleanup of a deleted App did not complete before the cleanup timeout.
+	ConditionCleanupStalled = "CleanupStalled"
+)
+
+// +kubebuilder:object:root=true
+// +kubebuilder:storageversion
+// +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
+// +kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.spec.replicas`
+// +kubebuilder:printcolumn:name="Current",type=integer,JSONPath=`.status.replicas`
+// +kubebuilder:printcolumn:name="Revision",type=integer,JSONPath=`.status.currentRevision`,priority=1
+// +kubebuilder:printcolumn:name="Active",type=string,JSONPath=`.status.blueGreen.activeColor`,priority=1
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Progressing",type=string,JSONPath=`.status.conditions[?(@.type=="Progressing")].status`,priority=1
+// +kubebuilder:printcolumn:name="Degraded",type=string,JSONPath=`.status.conditions[?(@.type=="Degraded")].status`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// App is the Schema for the apps API
+type App struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AppSpec   `json:"spec,omitempty"`
+	Status AppStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// AppList contains a list of App
+type AppList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []App `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&App{}, &AppList{})
+}
@@ -0,0 +1,425 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// log is for logging in this package.
+var applog = logf.Log.WithName("app-resource")
+
+// Default resource requests of the container, used when spec.resources is empty.
+var (
+	defaultCPURequest    = resource.MustParse("100m")
+	defaultMemoryRequest = resource.MustParse("128Mi")
+)
+
+// SetupWebhookWithManager will setup the manager to manage the webhooks.
+// defaultPolicies returns the policies set on the Apps that leave them empty; it may be nil.
+// App 同时注册了 Hub(v1) 和 spoke(v1beta1) 类型，For 会自动在 webhook server 上注册 /convert 端点
+func (r *App) SetupWebhookWithManager(mgr ctrl.Manager, defaultPolicies func() (DeletionPolicy, DriftPolicy)) error {
+	applog.Info("registering webhooks", "kind", "App")
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		WithDefaulter(&AppCustomDefaulter{DefaultPolicies: defaultPolicies}).
+		WithValidator(&AppCustomValidator{}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate-aloys-aloys-tech-v1-app,mutating=true,failurePolicy=fail,sideEffects=None,groups=aloys.aloys.tech,resources=apps,verbs=create;update,versions=v1,name=mapp.kb.io,admissionReviewVersions=v1
+
+// AppCustomDefaulter sets the defaults of an App on create and update.
+// +kubebuilder:object:generate=false
+type AppCustomDefaulter struct {
+	// DefaultPolicies returns the deletion and drift policies of the Apps that do not set them.
+	// Delete and Correct are used when it is nil.
+	// 默认策略来自 operator 的配置文件，修改后不需要重启即可生效；策略在准入时写入 spec，已有的 App 不受影响
+	DefaultPolicies func() (DeletionPolicy, DriftPolicy)
+}
+
+var _ webhook.CustomDefaulter = &AppCustomDefaulter{}
+
+// Default implements webhook.CustomDefaulter.
+func (d *AppCustomDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	app, ok := obj.(*App)
+	if !ok {
+		return fmt.Errorf("expected an App object but got %T", obj)
+	}
+	applog.Info("default", "name", app.Name)
+
+	spec := &app.Spec
+	if spec.ImagePullPolicy == "" {
+		spec.ImagePullPolicy = DefaultImagePullPolicy(spec.Image)
+	}
+	if spec.Replicas == nil {
+		spec.Replicas = ptr.To[int32](1)
+	}
+	// 没有设置任何资源时给一个较小的 requests，保证 HPA 的利用率指标可以计算
+	if len(spec.Resources.Requests) == 0 && len(spec.Resources.Limits) == 0 {
+		spec.Resources.Requests = corev1.ResourceList{
+			corev1.ResourceCPU:    defaultCPURequest,
+			corev1.ResourceMemory: defaultMemoryRequest,
+		}
+	}
+	// 有端口时默认对第一个端口做 TCP 探测
+	if len(spec.Ports) > 0 {
+		port := intstr.FromInt32(spec.Ports[0].ContainerPort)
+		if spec.ReadinessProbe == nil {
+			spec.ReadinessProbe = &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: port}},
+			}
+		}
+		if spec.LivenessProbe == nil {
+			spec.LivenessProbe = &corev1.Probe{
+				ProbeHandler:        corev1.ProbeHandler{TCPSocket: &corev1.TCPSocketAction{Port: port}},
+				InitialDelaySeconds: 15,
+			}
+		}
+	}
+	defaultProbe(spec.ReadinessProbe)
+	defaultProbe(spec.LivenessProbe)
+	if spec.Service != nil && spec.Service.Type == "" {
+		spec.Service.Type = corev1.ServiceTypeClusterIP
+	}
+	deletionPolicy, driftPolicy := DeletionPolicyDelete, DriftPolicyCorrect
+	if d.DefaultPolicies != nil {
+		deletionPolicy, driftPolicy = d.DefaultPolicies()
+	}
+	if spec.DeletionPolicy == "" {
+		spec.DeletionPolicy = deletionPolicy
+	}
+	if spec.DeletionPolicy == DeletionPolicyRetain && len(spec.RetainKinds) == 0 {
+		spec.RetainKinds = []string{"PersistentVolumeClaim"}
+	}
+	if spec.DriftPolicy == "" {
+		spec.DriftPolicy = driftPolicy
+	}
+	return nil
+}
+
+// defaultProbe sets the fields of a probe the same way the apiserver does, so the
+// Deployment generated from the App does not differ from what is stored.
+func defaultProbe(p *corev1.Probe) {
+	if p == nil {
+		return
+	}
+	if p.TimeoutSeconds == 0 {
+		p.TimeoutSeconds = 1
+	}
+	if p.PeriodSeconds == 0 {
+		p.PeriodSeconds = 10
+	}
+	if p.SuccessThreshold == 0 {
+		p.SuccessThreshold = 1
+	}
+	if p.FailureThreshold == 0 {
+		p.FailureThreshold = 3
+	}
+	if p.HTTPGet != nil && p.HTTPGet.Scheme == "" {
+		p.HTTPGet.Scheme = corev1.URISchemeHTTP
+	}
+}
+
+// DefaultImagePullPolicy returns the pull policy the apiserver would use for the image:
+// Always for the latest tag or an untagged image, IfNotPresent otherwise.
+func DefaultImagePullPolicy(image string) corev1.PullPolicy {
+	if strings.Contains(image, "@") {
+		return corev1.PullIfNotPresent
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	if i < 0 || name[i+1:] == "latest" {
+		return corev1.PullAlways
+	}
+	return corev1.PullIfNotPresent
+}
+
+// +kubebuilder:webhook:path=/validate-aloys-aloys-tech-v1-app,mutating=false,failurePolicy=fail,sideEffects=None,groups=aloys.aloys.tech,resources=apps,verbs=create;update,versions=v1,name=vapp.kb.io,admissionReviewVersions=v1
+
+// AppCustomValidator rejects invalid Apps on create and update.
+type AppCustomValidator struct{}
+
+var _ webhook.CustomValidator = &AppCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator.
+func (v *AppCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	app, ok := obj.(*App)
+	if !ok {
+		return nil, fmt.Errorf("expected an App object but got %T", obj)
+	}
+	applog.Info("validate create", "name", app.Name)
+	auditForceFinalize(ctx, nil, app)
+	warnings, errs := validateSpec(app)
+	annWarnings, annErrs := validateForceFinalize(app)
+	return appValidationResult(app, append(warnings, annWarnings...), append(errs, annErrs...))
+}
+
+// ValidateUpdate implements webhook.CustomValidator. Only the changes are validated: an App
+// created before a rule was added can still be updated as long as the update does not add
+// new errors, and the spec is not validated at all when it is unchanged or the App is being
+// deleted, so that the pause and force-finalize annotations and the finalizer always apply.
+func (v *AppCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	app, ok := newObj.(*App)
+	if !ok {
+		return nil, fmt.Errorf("expected an App object but got %T", newObj)
+	}
+	oldApp, ok := oldObj.(*App)
+	if !ok {
+		return nil, fmt.Errorf("expected an App object but got %T", oldObj)
+	}
+	applog.Info("validate update", "name", app.Name)
+	auditForceFinalize(ctx, oldApp, app)
+
+	var warnings admission.Warnings
+	var errs field.ErrorList
+	// force-finalize 的原因只在注解变化时检查，已有的注解不能阻止控制器移除 finalizer
+	if reason, ok := app.Annotations[AnnotationForceFinalize]; ok {
+		if oldReason, had := oldApp.Annotations[AnnotationForceFinalize]; !had || oldReason != reason {
+			warnings, errs = validateForceFinalize(app)
+		}
+	}
+	// 删除中的 App 只剩下清理，spec 不会再生效
+	if !app.DeletionTimestamp.IsZero() || equality.Semantic.DeepEqual(oldApp.Spec, app.Spec) {
+		return appValidationResult(app, warnings, errs)
+	}
+
+	specWarnings, specErrs := validateSpec(app)
+	_, oldErrs := validateSpec(oldApp)
+	return appValidationResult(app, append(warnings, specWarnings...), append(errs, newErrors(specErrs, oldErrs)...))
+}
+
+// ValidateDelete implements webhook.CustomValidator.
+func (v *AppCustomValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// auditForceFinalize logs who set the force-finalize annotation and why, since it lets the
+// finalizer skip the cleanup of the App. The controller records it again in a Warning Event.
+func auditForceFinalize(ctx context.Context, oldApp, app *App) {
+	reason, ok := app.Annotations[AnnotationForceFinalize]
+	if !ok || (oldApp != nil && oldApp.Annotations[AnnotationForceFinalize] == reason) {
+		return
+	}
+	user := ""
+	if req, err := admission.RequestFromContext(ctx); err == nil {
+		user = req.UserInfo.Username
+	}
+	applog.Info("force-finalize requested", "namespace", app.Namespace, "name", app.Name, "user", user, "reason", reason)
+}
+
+// validateSpec returns the warnings and the field errors of the spec of the App.
+// 所有错误一次性收集后返回，用户可以一次看到全部问题
+func validateSpec(app *App) (admission.Warnings, field.ErrorList) {
+	var warnings admission.Warnings
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if strings.TrimSpace(app.Spec.Image) == "" {
+		errs = append(errs, field.Required(specPath.Child("image"), "image must not be empty"))
+	} else if strings.ContainsAny(app.Spec.Image, " \t\n") {
+		errs = append(errs, field.Invalid(specPath.Child("image"), app.Spec.Image, "image must not contain whitespace"))
+	}
+
+	errs = append(errs, validatePorts(app.Spec.Ports, specPath.Child("ports"))...)
+
+	if svc := app.Spec.Service; svc != nil {
+		errs = append(errs, validateServicePorts(svc.Ports, app.Spec.Ports, specPath.Child("service", "ports"))...)
+	}
+
+	if ing := app.Spec.Ingress; ing != nil {
+		ingPath := specPath.Child("ingress")
+		hosts := sets.New[string]()
+		for i, h := range ing.Hosts {
+			hostPath := ingPath.Child("hosts").Index(i)
+			for _, msg := range validation.IsDNS1123Subdomain(strings.TrimPrefix(h.Host, "*.")) {
+				errs = append(errs, field.Invalid(hostPath.Child("host"), h.Host, msg))
+			}
+			if hosts.Has(h.Host) {
+				errs = append(errs, field.Duplicate(hostPath.Child("host"), h.Host))
+			}
+			hosts.Insert(h.Host)
+			for j, p := range h.Paths {
+				if p.Port != 0 {
+					errs = append(errs, validatePortNumber(p.Port, hostPath.Child("paths").Index(j).Child("port"))...)
+				}
+			}
+		}
+		for i, t := range ing.TLS {
+			for j, h := range t.Hosts {
+				if !hosts.Has(h) {
+					errs = append(errs, field.NotFound(ingPath.Child("tls").Index(i).Child("hosts").Index(j), h))
+				}
+			}
+		}
+		if ing.TLSSecretName != "" {
+			warnings = append(warnings, "spec.ingress.tlsSecretName is deprecated, use spec.ingress.tls instead")
+		}
+	}
+
+	if as := app.Spec.Autoscaling; as != nil {
+		asPath := specPath.Child("autoscaling")
+		if minReplicas := ptr.Deref(as.MinReplicas, 1); minReplicas > as.MaxReplicas {
+			errs = append(errs, field.Invalid(asPath.Child("minReplicas"), minReplicas,
+				fmt.Sprintf("must be less than or equal to maxReplicas (%d)", as.MaxReplicas)))
+		}
+		if (as.TargetCPUUtilizationPercentage != nil && app.Spec.Resources.Requests.Cpu().IsZero() && app.Spec.Resources.Limits.Cpu().IsZero()) ||
+			(as.TargetMemoryUtilizationPercentage != nil && app.Spec.Resources.Requests.Memory().IsZero() && app.Spec.Resources.Limits.Memory().IsZero()) {
+			warnings = append(warnings, "utilization targets require resource requests, the HorizontalPodAutoscaler cannot compute them otherwise")
+		}
+	}
+
+	if st := app.Spec.Strategy; st != nil {
+		stPath := specPath.Child("strategy")
+		if st.Canary != nil && st.BlueGreen != nil {
+			errs = append(errs, field.Forbidden(stPath.Child("blueGreen"), "canary and blueGreen are mutually exclusive"))
+		}
+		if bg := st.BlueGreen; bg != nil && bg.ScaleDownDelay != nil && bg.ScaleDownDelay.Duration < 0 {
+			errs = append(errs, field.Invalid(stPath.Child("blueGreen", "scaleDownDelay"), bg.ScaleDownDelay.Duration.String(), "must not be negative"))
+		}
+	}
+
+	if len(app.Spec.RetainKinds) > 0 && app.Spec.DeletionPolicy != DeletionPolicyRetain {
+		warnings = append(warnings, "spec.retainKinds is ignored unless spec.deletionPolicy is Retain")
+	}
+	return warnings, errs
+}
+
+// validateForceFinalize validates the force-finalize annotation of the App.
+// force-finalize 会跳过未完成的清理，必须写明原因，原因会被记录到 Event 中
+func validateForceFinalize(app *App) (admission.Warnings, field.ErrorList) {
+	reason, ok := app.Annotations[AnnotationForceFinalize]
+	if !ok {
+		return nil, nil
+	}
+	if strings.TrimSpace(reason) == "" {
+		return nil, field.ErrorList{field.Required(field.NewPath("metadata", "annotations").Key(AnnotationForceFinalize),
+			"the reason for skipping the cleanup must be given")}
+	}
+	if app.DeletionTimestamp.IsZero() {
+		return admission.Warnings{fmt.Sprintf("%s only takes effect once the App is deleted: "+
+			"if its cleanup then fails, the App is released and the remaining resources are left behind", AnnotationForceFinalize)}, nil
+	}
+	return nil, nil
+}
+
+// newErrors returns the errors of errs that are not in oldErrs, i.e. the errors introduced by an update.
+// 按字段、类型和取值比较，旧对象上已经存在的错误不再阻止更新
+func newErrors(errs, oldErrs field.ErrorList) field.ErrorList {
+	var added field.ErrorList
+	for _, err := range errs {
+		found := false
+		for _, old := range oldErrs {
+			if err.Type == old.Type && err.Field == old.Field && equality.Semantic.DeepEqual(err.BadValue, old.BadValue) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			added = append(added, err)
+		}
+	}
+	return added
+}
+
+// appValidationResult returns the warnings and, if there are any errors, an Invalid error for the App.
+func appValidationResult(app *App, warnings admission.Warnings, errs field.ErrorList) (admission.Warnings, error) {
+	if len(errs) == 0 {
+		return warnings, nil
+	}
+	return warnings, apierrors.NewInvalid(GroupVersion.WithKind("App").GroupKind(), app.Name, errs)
+}
+
+// validatePorts validates the container ports: valid numbers, unique names and unique port/protocol pairs.
+func validatePorts(ports []corev1.ContainerPort, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	names := sets.New[string]()
+	used := sets.New[string]()
+	for i, p := range ports {
+		idxPath := fldPath.Index(i)
+		errs = append(errs, validatePortNumber(p.ContainerPort, idxPath.Child("containerPort"))...)
+		if p.HostPort != 0 {
+			errs = append(errs, validatePortNumber(p.HostPort, idxPath.Child("hostPort"))...)
+		}
+		if p.Name != "" {
+			for _, msg := range validation.IsValidPortName(p.Name) {
+				errs = append(errs, field.Invalid(idxPath.Child("name"), p.Name, msg))
+			}
+			if names.Has(p.Name) {
+				errs = append(errs, field.Duplicate(idxPath.Child("name"), p.Name))
+			}
+			names.Insert(p.Name)
+		}
+		protocol := p.Protocol
+		if protocol == "" {
+			protocol = corev1.ProtocolTCP
+		}
+		key := fmt.Sprintf("%d/%s", p.ContainerPort, protocol)
+		if used.Has(key) {
+			errs = append(errs, field.Duplicate(idxPath, key))
+		}
+		used.Insert(key)
+	}
+	return errs
+}
+
+// validateServicePorts validates the Service ports. Named target ports must reference a container port.
+func validateServicePorts(ports []corev1.ServicePort, containerPorts []corev1.ContainerPort, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	names := sets.New[string]()
+	for _, p := range containerPorts {
+		if p.Name != "" {
+			names.Insert(p.Name)
+		}
+	}
+	for i, p := range ports {
+		idxPath := fldPath.Index(i)
+		errs = append(errs, validatePortNumber(p.Port, idxPath.Child("port"))...)
+		switch {
+		case p.TargetPort.Type == intstr.String && !names.Has(p.TargetPort.StrVal):
+			errs = append(errs, field.NotFound(idxPath.Child("targetPort"), p.TargetPort.StrVal))
+		case p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal != 0:
+			errs = append(errs, validatePortNumber(p.TargetPort.IntVal, idxPath.Child("targetPort"))...)
+		}
+	}
+	return errs
+}
+
+func validatePortNumber(port int32, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for _, msg := range validation.IsValidPortNum(int(port)) {
+		errs = append(errs, field.Invalid(fldPath, port, msg))
+	}
+	return errs
+}
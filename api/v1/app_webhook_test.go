@@ -0,0 +1,258 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/rest"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// warningRecorder collects the admission warnings returned by the apiserver.
+type warningRecorder struct {
+	mu       sync.Mutex
+	warnings []string
+}
+
+func (w *warningRecorder) HandleWarningHeader(code int, agent string, text string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = append(w.warnings, text)
+}
+
+func (w *warningRecorder) Warnings() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.warnings...)
+}
+
+var _ = Describe("App Webhook", func() {
+	var app *App
+
+	BeforeEach(func() {
+		app = &App{
+			ObjectMeta: metav1.ObjectMeta{GenerateName: "app-", Namespace: "default"},
+			Spec: AppSpec{
+				Image: "nginx:1.25",
+				Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 80}},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		if app.Name != "" {
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, app))).To(Succeed())
+		}
+	})
+
+	Context("When creating App under Defaulting Webhook", func() {
+		It("Should fill in the default values", func() {
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			Expect(app.Spec.ImagePullPolicy).To(Equal(corev1.PullIfNotPresent))
+			Expect(app.Spec.Replicas).To(Equal(ptr.To[int32](1)))
+			Expect(app.Spec.Resources.Requests.Cpu().Equal(resource.MustParse("100m"))).To(BeTrue())
+			Expect(app.Spec.Resources.Requests.Memory().Equal(resource.MustParse("128Mi"))).To(BeTrue())
+			Expect(app.Spec.ReadinessProbe).NotTo(BeNil())
+			Expect(app.Spec.ReadinessProbe.TCPSocket.Port).To(Equal(intstr.FromInt32(80)))
+			Expect(app.Spec.ReadinessProbe.PeriodSeconds).To(Equal(int32(10)))
+			Expect(app.Spec.LivenessProbe).NotTo(BeNil())
+			Expect(app.Spec.DeletionPolicy).To(Equal(DeletionPolicyDelete))
+			Expect(app.Spec.DriftPolicy).To(Equal(DriftPolicyCorrect))
+		})
+
+		It("Should use the configured default policies", func() {
+			setConfiguredPolicies(DeletionPolicyRetain, DriftPolicyReport)
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+			Expect(app.Spec.DeletionPolicy).To(Equal(DeletionPolicyRetain))
+			Expect(app.Spec.RetainKinds).To(Equal([]string{"PersistentVolumeClaim"}))
+			Expect(app.Spec.DriftPolicy).To(Equal(DriftPolicyReport))
+
+			By("Keeping the policies of the existing Apps when the configuration changes")
+			setConfiguredPolicies(DeletionPolicyOrphan, DriftPolicyCorrect)
+			app.Spec.Replicas = ptr.To[int32](2)
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			Expect(app.Spec.DeletionPolicy).To(Equal(DeletionPolicyRetain))
+			Expect(app.Spec.DriftPolicy).To(Equal(DriftPolicyReport))
+		})
+
+		It("Should keep the values set by the user", func() {
+			app.Spec.Image = "nginx"
+			app.Spec.Replicas = ptr.To[int32](3)
+			app.Spec.Resources.Limits = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("1")}
+			app.Spec.ReadinessProbe = &corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.FromString("http")}},
+			}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			// 没有 tag 的镜像默认总是拉取
+			Expect(app.Spec.ImagePullPolicy).To(Equal(corev1.PullAlways))
+			Expect(app.Spec.Replicas).To(Equal(ptr.To[int32](3)))
+			Expect(app.Spec.Resources.Requests).To(BeEmpty())
+			Expect(app.Spec.ReadinessProbe.HTTPGet.Path).To(Equal("/healthz"))
+			Expect(app.Spec.ReadinessProbe.HTTPGet.Scheme).To(Equal(corev1.URISchemeHTTP))
+		})
+	})
+
+	Context("When creating or updating App under Validating Webhook", func() {
+		It("Should deny an empty image", func() {
+			app.Spec.Image = " "
+			err := k8sClient.Create(ctx, app)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("spec.image"))
+		})
+
+		It("Should deny invalid and duplicate ports", func() {
+			app.Spec.Ports = []corev1.ContainerPort{
+				{Name: "http", ContainerPort: 80},
+				{Name: "http", ContainerPort: 70000},
+			}
+			err := k8sClient.Create(ctx, app)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("spec.ports[1].containerPort"))
+			Expect(err.Error()).To(ContainSubstring("spec.ports[1].name"))
+		})
+
+		It("Should deny a Service target port that is not a container port", func() {
+			app.Spec.Service = &ServiceSpec{
+				Ports: []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromString("web")}},
+			}
+			err := k8sClient.Create(ctx, app)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("spec.service.ports[0].targetPort"))
+		})
+
+		It("Should deny minReplicas greater than maxReplicas on update", func() {
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			app.Spec.Autoscaling = &AutoscalingSpec{MinReplicas: ptr.To[int32](5), MaxReplicas: 2}
+			err := k8sClient.Update(ctx, app)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("spec.autoscaling.minReplicas"))
+		})
+
+		It("Should deny canary and blue/green strategies together", func() {
+			app.Spec.Strategy = &AppStrategy{
+				Canary:    &CanaryStrategy{Steps: []CanaryStep{{Weight: 20}}},
+				BlueGreen: &BlueGreenStrategy{},
+			}
+			err := k8sClient.Create(ctx, app)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("spec.strategy"))
+		})
+
+		It("Should deny the force-finalize annotation without a reason", func() {
+			app.Annotations = map[string]string{AnnotationForceFinalize: " "}
+			err := k8sClient.Create(ctx, app)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring(AnnotationForceFinalize))
+		})
+
+		It("Should warn about the deprecated tlsSecretName", func() {
+			recorder := &warningRecorder{}
+			warnCfg := rest.CopyConfig(cfg)
+			warnCfg.WarningHandler = recorder
+			warnClient, err := client.New(warnCfg, client.Options{Scheme: k8sClient.Scheme()})
+			Expect(err).NotTo(HaveOccurred())
+
+			app.Spec.Service = &ServiceSpec{}
+			app.Spec.Ingress = &IngressSpec{
+				Hosts:         []IngressHost{{Host: "app.example.com"}},
+				TLSSecretName: "app-tls",
+			}
+			Expect(warnClient.Create(ctx, app)).To(Succeed())
+			Expect(recorder.Warnings()).To(ContainElement(ContainSubstring("spec.ingress.tlsSecretName is deprecated")))
+		})
+
+		It("Should let a deleted App release its finalizer", func() {
+			app.Finalizers = []string{"aloys.tech/test"}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(app), app)).To(Succeed())
+			Expect(app.DeletionTimestamp).NotTo(BeNil())
+
+			app.Annotations = map[string]string{AnnotationPaused: "true", AnnotationForceFinalize: "cluster decommissioned"}
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			app.Finalizers = nil
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(app), app)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+	})
+
+	// 已存在的 App 可能不符合后来新增的校验规则，apiserver 中无法创建这样的对象，直接调用 validator
+	Context("When updating an App that is invalid under the current rules", func() {
+		var validator *AppCustomValidator
+		var invalid *App
+
+		BeforeEach(func() {
+			validator = &AppCustomValidator{}
+			invalid = app.DeepCopy()
+			invalid.Name = "legacy"
+			invalid.Spec.Autoscaling = &AutoscalingSpec{MinReplicas: ptr.To[int32](5), MaxReplicas: 2}
+		})
+
+		It("Should allow updates that do not change the spec", func() {
+			updated := invalid.DeepCopy()
+			updated.Annotations = map[string]string{AnnotationPaused: "true"}
+			_, err := validator.ValidateUpdate(ctx, invalid, updated)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should allow any update once the App is being deleted", func() {
+			invalid.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			invalid.Finalizers = []string{"aloys.tech/test"}
+			updated := invalid.DeepCopy()
+			updated.Finalizers = nil
+			updated.Spec.Image = ""
+			_, err := validator.ValidateUpdate(ctx, invalid, updated)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should only deny the errors introduced by the update", func() {
+			updated := invalid.DeepCopy()
+			updated.Spec.Image = "nginx:1.26"
+			_, err := validator.ValidateUpdate(ctx, invalid, updated)
+			Expect(err).NotTo(HaveOccurred())
+
+			updated.Spec.Ports = append(updated.Spec.Ports, corev1.ContainerPort{Name: "http", ContainerPort: 8080})
+			_, err = validator.ValidateUpdate(ctx, invalid, updated)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring("spec.ports[1].name"))
+			Expect(err.Error()).NotTo(ContainSubstring("spec.autoscaling.minReplicas"))
+		})
+
+		It("Should still deny a force-finalize annotation without a reason", func() {
+			invalid.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+			updated := invalid.DeepCopy()
+			updated.Annotations = map[string]string{AnnotationForceFinalize: ""}
+			_, err := validator.ValidateUpdate(ctx, invalid, updated)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+			Expect(err.Error()).To(ContainSubstring(AnnotationForceFinalize))
+		})
+	})
+})
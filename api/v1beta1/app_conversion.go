@@ -0,0 +1,310 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"encoding/json"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// conversionDataAnnotation 保存 v1 中 v1beta1 无法表示的字段，v1 -> v1beta1 -> v1 往返转换时据此恢复，保证不丢数据
+const conversionDataAnnotation = "aloys.tech/conversion-data"
+
+// conversionStatusAnnotation 保存 v1 status 中 v1beta1 没有的字段。通过 v1beta1 更新 status 时请求中带着这个注解，
+// 转换回 v1 时据此恢复，避免控制器写入的 canary、回滚、清理等状态被清空
+const conversionStatusAnnotation = "aloys.tech/conversion-status"
+
+// ConvertTo converts this App to the Hub version (v1).
+func (src *App) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*aloysv1.App)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	convertSpecToV1(&src.Spec, &dst.Spec)
+	convertStatusToV1(&src.Status, &dst.Status)
+
+	// 恢复只存在于 v1 中的 status 字段
+	restoredStatus := &aloysv1.AppStatus{}
+	ok, err := unmarshalConversionData(dst, conversionStatusAnnotation, restoredStatus)
+	if err != nil {
+		return err
+	}
+	if ok {
+		dst.Status.Canary = restoredStatus.Canary
+		dst.Status.BlueGreen = restoredStatus.BlueGreen
+		dst.Status.CurrentRevision = restoredStatus.CurrentRevision
+		dst.Status.LastHealthyRevision = restoredStatus.LastHealthyRevision
+		dst.Status.LastRollback = restoredStatus.LastRollback
+		dst.Status.ExternalResources = restoredStatus.ExternalResources
+		dst.Status.Cleanup = restoredStatus.Cleanup
+		dst.Status.Drift = restoredStatus.Drift
+	}
+
+	// 恢复只存在于 v1 中的 spec 字段
+	restored := &aloysv1.AppSpec{}
+	ok, err = unmarshalConversionData(dst, conversionDataAnnotation, restored)
+	if err != nil || !ok {
+		return err
+	}
+	dst.Spec.ImagePullPolicy = restored.ImagePullPolicy
+	dst.Spec.ImagePullSecrets = restored.ImagePullSecrets
+	dst.Spec.LivenessProbe = restored.LivenessProbe
+	dst.Spec.ReadinessProbe = restored.ReadinessProbe
+	dst.Spec.Strategy = restored.Strategy
+	dst.Spec.ProgressDeadlineSeconds = restored.ProgressDeadlineSeconds
+	dst.Spec.RevisionHistoryLimit = restored.RevisionHistoryLimit
+	dst.Spec.RollbackTo = restored.RollbackTo
+	dst.Spec.Paused = restored.Paused
+	dst.Spec.DeletionPolicy = restored.DeletionPolicy
+	dst.Spec.RetainKinds = restored.RetainKinds
+	dst.Spec.DriftPolicy = restored.DriftPolicy
+	// 只有在 v1beta1 上没有修改过 TLS 时才恢复 v1 中更细粒度的 TLS 配置
+	if src.Spec.Ingress != nil && restored.Ingress != nil {
+		down := &IngressSpec{}
+		convertIngressFromV1(restored.Ingress, down)
+		if down.TLSSecretName == src.Spec.Ingress.TLSSecretName {
+			dst.Spec.Ingress.TLS = restored.Ingress.TLS
+			dst.Spec.Ingress.TLSSecretName = restored.Ingress.TLSSecretName
+		}
+	}
+	return nil
+}
+
+// ConvertFrom converts from the Hub version (v1) to this version.
+func (dst *App) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*aloysv1.App)
+
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	convertSpecFromV1(&src.Spec, &dst.Spec)
+	convertStatusFromV1(&src.Status, &dst.Status)
+
+	// 把完整的 v1 spec 和 v1 独有的 status 保存在注解中，转换回 v1 时用来恢复 v1beta1 中不存在的字段
+	if err := marshalConversionStatus(&src.Status, dst); err != nil {
+		return err
+	}
+	return marshalConversionData(&src.Spec, dst)
+}
+
+func convertSpecToV1(src *AppSpec, dst *aloysv1.AppSpec) {
+	dst.Image = src.Image
+	dst.Replicas = src.Replicas
+	dst.Ports = src.Ports
+	dst.Env = src.Env
+	dst.EnvFrom = src.EnvFrom
+	dst.Volumes = src.Volumes
+	dst.VolumeMounts = src.VolumeMounts
+	dst.Resources = src.Resources
+	dst.Command = src.Command
+	dst.Args = src.Args
+
+	dst.Service = nil
+	if src.Service != nil {
+		dst.Service = &aloysv1.ServiceSpec{
+			Type:        src.Service.Type,
+			Ports:       src.Service.Ports,
+			Annotations: src.Service.Annotations,
+		}
+	}
+
+	dst.Ingress = nil
+	if src.Ingress != nil {
+		dst.Ingress = &aloysv1.IngressSpec{
+			IngressClassName: src.Ingress.IngressClassName,
+		}
+		for _, h := range src.Ingress.Hosts {
+			host := aloysv1.IngressHost{Host: h.Host}
+			for _, p := range h.Paths {
+				host.Paths = append(host.Paths, aloysv1.IngressPath{Path: p.Path, PathType: p.PathType, Port: p.Port})
+			}
+			dst.Ingress.Hosts = append(dst.Ingress.Hosts, host)
+		}
+		// v1beta1 的 tlsSecretName 在 v1 中已废弃，转换为覆盖所有 host 的 tls
+		if src.Ingress.TLSSecretName != "" {
+			dst.Ingress.TLS = []aloysv1.IngressTLS{{SecretName: src.Ingress.TLSSecretName}}
+		}
+	}
+
+	dst.Autoscaling = nil
+	if src.Autoscaling != nil {
+		dst.Autoscaling = &aloysv1.AutoscalingSpec{
+			MinReplicas:                       src.Autoscaling.MinReplicas,
+			MaxReplicas:                       src.Autoscaling.MaxReplicas,
+			TargetCPUUtilizationPercentage:    src.Autoscaling.TargetCPUUtilizationPercentage,
+			TargetMemoryUtilizationPercentage: src.Autoscaling.TargetMemoryUtilizationPercentage,
+			Metrics:                           src.Autoscaling.Metrics,
+		}
+	}
+}
+
+func convertSpecFromV1(src *aloysv1.AppSpec, dst *AppSpec) {
+	dst.Image = src.Image
+	dst.Replicas = src.Replicas
+	dst.Ports = src.Ports
+	dst.Env = src.Env
+	dst.EnvFrom = src.EnvFrom
+	dst.Volumes = src.Volumes
+	dst.VolumeMounts = src.VolumeMounts
+	dst.Resources = src.Resources
+	dst.Command = src.Command
+	dst.Args = src.Args
+
+	dst.Service = nil
+	if src.Service != nil {
+		dst.Service = &ServiceSpec{
+			Type:        src.Service.Type,
+			Ports:       src.Service.Ports,
+			Annotations: src.Service.Annotations,
+		}
+	}
+
+	dst.Ingress = nil
+	if src.Ingress != nil {
+		dst.Ingress = &IngressSpec{}
+		convertIngressFromV1(src.Ingress, dst.Ingress)
+	}
+
+	dst.Autoscaling = nil
+	if src.Autoscaling != nil {
+		dst.Autoscaling = &AutoscalingSpec{
+			MinReplicas:                       src.Autoscaling.MinReplicas,
+			MaxReplicas:                       src.Autoscaling.MaxReplicas,
+			TargetCPUUtilizationPercentage:    src.Autoscaling.TargetCPUUtilizationPercentage,
+			TargetMemoryUtilizationPercentage: src.Autoscaling.TargetMemoryUtilizationPercentage,
+			Metrics:                           src.Autoscaling.Metrics,
+		}
+	}
+}
+
+func convertIngressFromV1(src *aloysv1.IngressSpec, dst *IngressSpec) {
+	dst.IngressClassName = src.IngressClassName
+	dst.Hosts = nil
+	for _, h := range src.Hosts {
+		host := IngressHost{Host: h.Host}
+		for _, p := range h.Paths {
+			host.Paths = append(host.Paths, IngressPath{Path: p.Path, PathType: p.PathType, Port: p.Port})
+		}
+		dst.Hosts = append(dst.Hosts, host)
+	}
+	// v1beta1 只能表示一个覆盖所有 host 的证书，取第一个；完整的 tls 通过注解保留
+	dst.TLSSecretName = src.TLSSecretName
+	if dst.TLSSecretName == "" && len(src.TLS) > 0 {
+		dst.TLSSecretName = src.TLS[0].SecretName
+	}
+}
+
+func convertStatusToV1(src *AppStatus, dst *aloysv1.AppStatus) {
+	dst.ObservedGeneration = src.ObservedGeneration
+	dst.Replicas = src.Replicas
+	dst.ReadyReplicas = src.ReadyReplicas
+	dst.Selector = src.Selector
+	dst.Phase = aloysv1.AppPhase(src.Phase)
+	dst.Conditions = src.Conditions
+	dst.URLs = src.URLs
+	dst.Autoscaling = nil
+	if src.Autoscaling != nil {
+		dst.Autoscaling = &aloysv1.AutoscalingStatus{
+			CurrentReplicas: src.Autoscaling.CurrentReplicas,
+			DesiredReplicas: src.Autoscaling.DesiredReplicas,
+		}
+	}
+}
+
+func convertStatusFromV1(src *aloysv1.AppStatus, dst *AppStatus) {
+	dst.ObservedGeneration = src.ObservedGeneration
+	dst.Replicas = src.Replicas
+	dst.ReadyReplicas = src.ReadyReplicas
+	dst.Selector = src.Selector
+	dst.Phase = AppPhase(src.Phase)
+	dst.Conditions = src.Conditions
+	dst.URLs = src.URLs
+	dst.Autoscaling = nil
+	if src.Autoscaling != nil {
+		dst.Autoscaling = &AutoscalingStatus{
+			CurrentReplicas: src.Autoscaling.CurrentReplicas,
+			DesiredReplicas: src.Autoscaling.DesiredReplicas,
+		}
+	}
+}
+
+// marshalConversionData stores the hub spec in an annotation of the spoke object.
+// 如果 v1 中的内容全部可以用 v1beta1 表示，则不写注解，避免给对象增加无用的数据
+func marshalConversionData(hub *aloysv1.AppSpec, spoke *App) error {
+	back := &aloysv1.AppSpec{}
+	convertSpecToV1(&spoke.Spec, back)
+	if equality.Semantic.DeepEqual(hub, back) {
+		delete(spoke.Annotations, conversionDataAnnotation)
+		return nil
+	}
+	data, err := json.Marshal(hub)
+	if err != nil {
+		return err
+	}
+	if spoke.Annotations == nil {
+		spoke.Annotations = map[string]string{}
+	}
+	spoke.Annotations[conversionDataAnnotation] = string(data)
+	return nil
+}
+
+// marshalConversionStatus stores the status fields that only exist in the hub in an annotation
+// of the spoke object. 没有这些字段时不写注解
+func marshalConversionStatus(hub *aloysv1.AppStatus, spoke *App) error {
+	only := aloysv1.AppStatus{
+		Canary:              hub.Canary,
+		BlueGreen:           hub.BlueGreen,
+		CurrentRevision:     hub.CurrentRevision,
+		LastHealthyRevision: hub.LastHealthyRevision,
+		LastRollback:        hub.LastRollback,
+		ExternalResources:   hub.ExternalResources,
+		Cleanup:             hub.Cleanup,
+		Drift:               hub.Drift,
+	}
+	if equality.Semantic.DeepEqual(only, aloysv1.AppStatus{}) {
+		delete(spoke.Annotations, conversionStatusAnnotation)
+		return nil
+	}
+	data, err := json.Marshal(only)
+	if err != nil {
+		return err
+	}
+	if spoke.Annotations == nil {
+		spoke.Annotations = map[string]string{}
+	}
+	spoke.Annotations[conversionStatusAnnotation] = string(data)
+	return nil
+}
+
+// unmarshalConversionData restores the data saved in the annotation key by marshalConversionData
+// or marshalConversionStatus and removes the annotation from the hub object. It reports whether
+// any data was found.
+func unmarshalConversionData(hub *aloysv1.App, key string, out any) (bool, error) {
+	data, ok := hub.Annotations[key]
+	if !ok {
+		return false, nil
+	}
+	delete(hub.Annotations, key)
+	if len(hub.Annotations) == 0 {
+		hub.Annotations = nil
+	}
+	if err := json.Unmarshal([]byte(data), out); err != nil {
+		return false, err
+	}
+	return true, nil
+}
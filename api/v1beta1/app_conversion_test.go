@@ -0,0 +1,143 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+var _ = Describe("App conversion", func() {
+	// 注解中的时间经过 JSON 序列化，只保留到秒
+	now := metav1.NewTime(time.Unix(1700000000, 0))
+
+	newHub := func() *aloysv1.App {
+		return &aloysv1.App{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: aloysv1.AppSpec{
+				Image:            "nginx:1.25",
+				Replicas:         ptr.To[int32](2),
+				ImagePullPolicy:  corev1.PullIfNotPresent,
+				ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}},
+				Service:          &aloysv1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+				Strategy: &aloysv1.AppStrategy{Canary: &aloysv1.CanaryStrategy{
+					Steps: []aloysv1.CanaryStep{{Weight: 20}},
+				}},
+				RevisionHistoryLimit: ptr.To[int32](5),
+				DriftPolicy:          aloysv1.DriftPolicyReport,
+				Ingress: &aloysv1.IngressSpec{
+					Hosts: []aloysv1.IngressHost{{Host: "a.example.com"}, {Host: "b.example.com"}},
+					TLS: []aloysv1.IngressTLS{
+						{Hosts: []string{"a.example.com"}, SecretName: "a-tls"},
+						{Hosts: []string{"b.example.com"}, SecretName: "b-tls"},
+					},
+				},
+			},
+			Status: aloysv1.AppStatus{
+				ObservedGeneration: 3,
+				Replicas:           2,
+				Phase:              aloysv1.AppPhaseRunning,
+				Canary: &aloysv1.CanaryStatus{
+					Revision: "abc", CurrentStep: 1, Weight: 20, StepStartedAt: &now,
+				},
+				BlueGreen: &aloysv1.BlueGreenStatus{
+					ActiveColor: "blue", ActiveRevision: "abc", PreviewColor: "green", PreviewRevision: "def",
+				},
+				CurrentRevision:     4,
+				LastHealthyRevision: "abc",
+				LastRollback: &aloysv1.RollbackStatus{
+					FailedRevision: "def", Revision: "abc", Reason: "ProgressDeadlineExceeded", Time: now,
+				},
+				ExternalResources: []aloysv1.ExternalResourceStatus{{Provider: "dns", ID: "app.example.com", Ready: true}},
+				Cleanup:           &aloysv1.CleanupStatus{StartTime: now, Attempts: 2, LastAttemptTime: &now, LastError: "timeout"},
+				Drift: []aloysv1.ResourceDrift{{
+					Kind: "Deployment", Name: "app", DetectedAt: now,
+					Fields: []aloysv1.FieldDrift{{Path: "spec.replicas", Desired: "2", Live: "3"}},
+				}},
+			},
+		}
+	}
+
+	It("should round trip v1 -> v1beta1 -> v1 without losing fields", func() {
+		hub := newHub()
+
+		spoke := &App{}
+		Expect(spoke.ConvertFrom(hub.DeepCopy())).To(Succeed())
+		Expect(spoke.Spec.Image).To(Equal("nginx:1.25"))
+		Expect(spoke.Spec.Ingress.TLSSecretName).To(Equal("a-tls"))
+		Expect(spoke.Status.Phase).To(Equal(AppPhaseRunning))
+		Expect(spoke.Annotations).To(HaveKey(conversionDataAnnotation))
+		Expect(spoke.Annotations).To(HaveKey(conversionStatusAnnotation))
+
+		back := &aloysv1.App{}
+		Expect(spoke.ConvertTo(back)).To(Succeed())
+		Expect(back).To(Equal(hub))
+	})
+
+	It("should not annotate objects that v1beta1 can represent", func() {
+		hub := newHub()
+		hub.Spec.ImagePullPolicy = ""
+		hub.Spec.ImagePullSecrets = nil
+		hub.Spec.Strategy = nil
+		hub.Spec.RevisionHistoryLimit = nil
+		hub.Spec.DriftPolicy = ""
+		hub.Spec.Ingress.TLS = []aloysv1.IngressTLS{{SecretName: "tls"}}
+		hub.Status = aloysv1.AppStatus{ObservedGeneration: 3, Replicas: 2, Phase: aloysv1.AppPhaseRunning}
+
+		spoke := &App{}
+		Expect(spoke.ConvertFrom(hub.DeepCopy())).To(Succeed())
+		Expect(spoke.Annotations).To(BeEmpty())
+		Expect(spoke.Spec.Ingress.TLSSecretName).To(Equal("tls"))
+
+		back := &aloysv1.App{}
+		Expect(spoke.ConvertTo(back)).To(Succeed())
+		Expect(back).To(Equal(hub))
+	})
+
+	It("should convert tlsSecretName changed on v1beta1 to a tls entry", func() {
+		spoke := &App{}
+		Expect(spoke.ConvertFrom(newHub())).To(Succeed())
+		spoke.Spec.Ingress.TLSSecretName = "new-tls"
+
+		hub := &aloysv1.App{}
+		Expect(spoke.ConvertTo(hub)).To(Succeed())
+		Expect(hub.Spec.Ingress.TLS).To(Equal([]aloysv1.IngressTLS{{SecretName: "new-tls"}}))
+		// v1 独有的其他字段仍然保留
+		Expect(hub.Spec.ImagePullPolicy).To(Equal(corev1.PullIfNotPresent))
+		Expect(hub.Annotations).NotTo(HaveKey(conversionDataAnnotation))
+	})
+
+	It("should keep the v1 status fields when the status is updated on v1beta1", func() {
+		spoke := &App{}
+		Expect(spoke.ConvertFrom(newHub())).To(Succeed())
+		spoke.Status.ReadyReplicas = 2
+
+		hub := &aloysv1.App{}
+		Expect(spoke.ConvertTo(hub)).To(Succeed())
+		want := newHub().Status
+		want.ReadyReplicas = 2
+		Expect(hub.Status).To(Equal(want))
+		Expect(hub.Annotations).NotTo(HaveKey(conversionStatusAnnotation))
+	})
+})
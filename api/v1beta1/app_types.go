@@ -19,6 +19,9 @@ limitations under the License.
 package v1beta1
 
 import (
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -26,22 +29,249 @@ import (
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
 // AppSpec defines the desired state of App
+// App 描述的是一个工作负载，controller 会根据 AppSpec 生成一个由 App 拥有(ownerReference)的 Deployment
+// +kubebuilder:validation:XValidation:rule="!has(self.ingress) || has(self.service)",message="spec.ingress requires spec.service"
 type AppSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// Foo is an example field of App. Edit app_types.go to remove/update
-	Foo string `json:"foo,omitempty"`
+	// Image is the container image the workload runs.
+	// +kubebuilder:validation:MinLength=1
+	Image string `json:"image"`
+
+	// Replicas is the desired number of pods. Defaults to 1.
+	// It is exposed through the scale subresource, so `kubectl scale` and HorizontalPodAutoscalers can target the App.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=1
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Ports lists the ports exposed by the container.
+	// +optional
+	Ports []corev1.ContainerPort `json:"ports,omitempty"`
+
+	// Env lists the environment variables set in the container.
+	// Changing a ConfigMap or Secret referenced by a value triggers a rolling restart of the App.
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// EnvFrom lists ConfigMaps and Secrets whose keys are exposed as environment variables.
+	// Changing a referenced ConfigMap or Secret triggers a rolling restart of the App.
+	// +optional
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+
+	// Volumes lists the volumes of the pod, e.g. ConfigMaps and Secrets mounted as files.
+	// Changing a referenced ConfigMap or Secret triggers a rolling restart of the App.
+	// +optional
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+
+	// VolumeMounts lists where the volumes are mounted in the container.
+	// +optional
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+
+	// Resources are the compute resources required by the container.
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Command overrides the image entrypoint.
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// Args are the arguments passed to the entrypoint.
+	// +optional
+	Args []string `json:"args,omitempty"`
+
+	// Service describes the Service exposing the App's pods.
+	// The Service is deleted when this block is removed.
+	// +optional
+	Service *ServiceSpec `json:"service,omitempty"`
+
+	// Ingress describes the Ingress routing external traffic to the App's Service.
+	// It requires spec.service to be set. The Ingress is deleted when this block is removed.
+	// +optional
+	Ingress *IngressSpec `json:"ingress,omitempty"`
+
+	// Autoscaling enables a HorizontalPodAutoscaler for the App. While it is set the
+	// HorizontalPodAutoscaler owns the replica count and spec.replicas is only used as the initial size.
+	// The HorizontalPodAutoscaler is deleted when this block is removed.
+	// +optional
+	Autoscaling *AutoscalingSpec `json:"autoscaling,omitempty"`
+}
+
+// ServiceSpec describes the Service managed for an App.
+type ServiceSpec struct {
+	// Type is the type of the Service. Defaults to ClusterIP.
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	// +optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// Ports lists the ports exposed by the Service.
+	// When empty, every container port is exposed on the same port number.
+	// +optional
+	Ports []corev1.ServicePort `json:"ports,omitempty"`
+
+	// Annotations are added to the Service, e.g. to configure a cloud load balancer.
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// IngressSpec describes the Ingress managed for an App.
+type IngressSpec struct {
+	// IngressClassName is the name of the IngressClass handling the Ingress.
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// Hosts lists the hosts routed to the App.
+	// +kubebuilder:validation:MinItems=1
+	Hosts []IngressHost `json:"hosts"`
+
+	// TLSSecretName is the name of the Secret holding the TLS certificate for all hosts.
+	// TLS is not configured when empty.
+	// +optional
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+}
+
+// IngressHost describes the routing of one host.
+type IngressHost struct {
+	// Host is the fully qualified domain name of the host.
+	Host string `json:"host"`
+
+	// Paths lists the paths routed to the App. Defaults to a single "/" prefix path.
+	// +optional
+	Paths []IngressPath `json:"paths,omitempty"`
+}
+
+// IngressPath describes one path routed to the App's Service.
+type IngressPath struct {
+	// Path is matched against the path of the incoming request. Defaults to "/".
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// PathType determines how Path is matched. Defaults to Prefix.
+	// +kubebuilder:validation:Enum=Exact;Prefix;ImplementationSpecific
+	// +optional
+	PathType *networkingv1.PathType `json:"pathType,omitempty"`
+
+	// Port is the Service port traffic is sent to. Defaults to the first Service port.
+	// +optional
+	Port int32 `json:"port,omitempty"`
+}
+
+// AutoscalingSpec describes the HorizontalPodAutoscaler managed for an App.
+type AutoscalingSpec struct {
+	// MinReplicas is the lower limit of the number of replicas. Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MinReplicas *int32 `json:"minReplicas,omitempty"`
+
+	// MaxReplicas is the upper limit of the number of replicas.
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+
+	// TargetCPUUtilizationPercentage is the target average CPU utilization, relative to the requested CPU.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TargetCPUUtilizationPercentage *int32 `json:"targetCPUUtilizationPercentage,omitempty"`
+
+	// TargetMemoryUtilizationPercentage is the target average memory utilization, relative to the requested memory.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	TargetMemoryUtilizationPercentage *int32 `json:"targetMemoryUtilizationPercentage,omitempty"`
+
+	// Metrics lists additional metrics, e.g. pods, object or external metrics, used to compute the replica count.
+	// +optional
+	Metrics []autoscalingv2.MetricSpec `json:"metrics,omitempty"`
+}
+
+// AutoscalingStatus reports the state of the App's HorizontalPodAutoscaler.
+type AutoscalingStatus struct {
+	// CurrentReplicas is the number of replicas last observed by the HorizontalPodAutoscaler.
+	CurrentReplicas int32 `json:"currentReplicas"`
+
+	// DesiredReplicas is the number of replicas last computed by the HorizontalPodAutoscaler.
+	DesiredReplicas int32 `json:"desiredReplicas"`
 }
 
 // AppStatus defines the observed state of App
 type AppStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// ObservedGeneration is the most recent generation of the App observed by the controller.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Replicas is the number of pods currently running for the App, ready or not.
+	// +optional
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// ReadyReplicas is the number of pods of the App that are ready.
+	// +optional
+	ReadyReplicas int32 `json:"readyReplicas,omitempty"`
+
+	// Selector is the label selector of the App's pods in string form, used by the scale subresource.
+	// +optional
+	Selector string `json:"selector,omitempty"`
+
+	// Autoscaling reports the state of the HorizontalPodAutoscaler when spec.autoscaling is set.
+	// +optional
+	Autoscaling *AutoscalingStatus `json:"autoscaling,omitempty"`
+
+	// Phase is a one-word summary of the App's state, computed from its conditions.
+	// +optional
+	Phase AppPhase `json:"phase,omitempty"`
+
+	// Conditions describe the current state of the App: Ready, Progressing and Degraded.
+	// +listType=map
+	// +listMapKey=type
+	// +patchStrategy=merge
+	// +patchMergeKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// URLs lists the URLs the App is reachable at through its Ingress.
+	// +optional
+	URLs []string `json:"urls,omitempty"`
 }
 
+// AppPhase is a one-word summary of the App's state.
+// +kubebuilder:validation:Enum=Pending;Progressing;Running;Degraded;Terminating
+type AppPhase string
+
+const (
+	// AppPhasePending means the workload has no available pods yet.
+	AppPhasePending AppPhase = "Pending"
+	// AppPhaseProgressing means a rollout is in progress.
+	AppPhaseProgressing AppPhase = "Progressing"
+	// AppPhaseRunning means the workload is fully rolled out and available.
+	AppPhaseRunning AppPhase = "Running"
+	// AppPhaseDegraded means the App failed to reconcile or its rollout is stuck.
+	AppPhaseDegraded AppPhase = "Degraded"
+	// AppPhaseTerminating means the App is being deleted.
+	AppPhaseTerminating AppPhase = "Terminating"
+)
+
+// Condition types of an App. They follow the kstatus conventions, so
+// `kubectl wait --for=condition=Ready` can be used against an App.
+const (
+	// ConditionReady is True when the workload is fully rolled out and available.
+	ConditionReady = "Ready"
+	// ConditionProgressing is True while the workload is rolling out.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is True when the App failed to reconcile or its rollout is stuck.
+	ConditionDegraded = "Degraded"
+)
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas,selectorpath=.status.selector
+// +kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.spec.replicas`
+// +kubebuilder:printcolumn:name="Current",type=integer,JSONPath=`.status.replicas`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Progressing",type=string,JSONPath=`.status.conditions[?(@.type=="Progressing")].status`,priority=1
+// +kubebuilder:printcolumn:name="Degraded",type=string,JSONPath=`.status.conditions[?(@.type=="Degraded")].status`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // App is the Schema for the apps API
 type App struct {
@@ -17,10 +17,15 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -28,13 +33,19 @@ import (
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	aloysv1 "kubebuilder-demo1/api/v1"
 	aloysv1beta1 "kubebuilder-demo1/api/v1beta1"
+	"kubebuilder-demo1/internal/config"
 	"kubebuilder-demo1/internal/controller"
+	"kubebuilder-demo1/internal/external"
+	"kubebuilder-demo1/internal/tracing"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -52,6 +63,7 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 	// 注册自己的gvk 到scheme
 	utilruntime.Must(aloysv1beta1.AddToScheme(scheme))
+	utilruntime.Must(aloysv1.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
@@ -61,6 +73,13 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var externalProviders string
+	var externalProviderDir string
+	var cleanupTimeout time.Duration
+	var tracingOpts tracing.Options
+	var configFile string
+	flag.StringVar(&configFile, "config", "",
+		"The path of the operator configuration file. The built-in defaults are used when empty.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -70,6 +89,20 @@ func main() {
 		"If set the metrics endpoint is served securely")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&externalProviders, "external-providers", "",
+		"Comma separated list of the external resource providers to enable: memory, file.")
+	flag.StringVar(&externalProviderDir, "external-provider-dir", "/tmp/app-operator/external",
+		"The directory the file external resource provider stores its resources in.")
+	flag.DurationVar(&cleanupTimeout, "cleanup-timeout", 10*time.Minute,
+		"How long the cleanup of a deleted App may take before its CleanupStalled condition is set.")
+	flag.StringVar(&tracingOpts.Endpoint, "tracing-endpoint", "",
+		"The host:port of the OTLP collector the traces are exported to. Tracing is disabled when empty.")
+	flag.StringVar(&tracingOpts.Protocol, "tracing-protocol", tracing.ProtocolGRPC,
+		"The protocol the traces are exported with: grpc or http.")
+	flag.BoolVar(&tracingOpts.Insecure, "tracing-insecure", false,
+		"If set, the traces are exported without TLS.")
+	flag.Float64Var(&tracingOpts.SamplingRatio, "tracing-sampling-ratio", 1,
+		"The ratio of the reconciles that are traced, from 0 to 1.")
 	opts := zap.Options{
 		// 设置为开发配置警告时使用stacktraces，不采样)，否则将使用Zap生产配置(错误时使用stacktraces，采样)。
 		Development: true,
@@ -81,6 +114,31 @@ func main() {
 	// ctrl.SetLogger 将zap日志设置为controller-runtime的日志
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	// 在创建 manager 之前设置全局的 TracerProvider，退出前导出剩余的 span
+	shutdownTracing, err := tracing.Setup(context.Background(), tracingOpts)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			setupLog.Error(err, "unable to flush the traces")
+		}
+	}()
+
+	// 配置文件在创建 manager 之前加载和校验，配置有误时直接退出
+	operatorConfig := config.DefaultOperatorConfig()
+	var configData []byte
+	if configFile != "" {
+		if operatorConfig, configData, err = config.Load(configFile); err != nil {
+			setupLog.Error(err, "unable to load the operator configuration")
+			os.Exit(1)
+		}
+	}
+	configStore := config.NewStore(operatorConfig)
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancelation and
@@ -153,7 +211,9 @@ func main() {
 		// RenewDeadline *time.Duration当选Leader后，刷新选举信息的间隔，其需要小于LeaseDuration，默认为10s
 		// RetryPeriod *time.Duration 候选人尝试竞选的时间间隔默认为2s
 		LeaderElection:   enableLeaderElection,
-		LeaderElectionID: "ada94d48.aloys.tech",
+		LeaderElectionID: operatorConfig.LeaderElection.ResourceName,
+		// SyncPeriod 和监听的 namespace 来自配置文件，没有配置 namespace 时监听所有 namespace
+		Cache: cacheOptions(operatorConfig.Cache),
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -171,19 +231,73 @@ func main() {
 		os.Exit(1)
 	}
 
+	// 集群外部的资源由注册的 provider 管理，接入新的后端只需要在这里注册
+	providers := external.NewRegistry()
+	for _, name := range strings.Split(externalProviders, ",") {
+		var provider external.ExternalResourceProvider
+		switch name = strings.TrimSpace(name); name {
+		case "":
+			continue
+		case "memory":
+			provider = external.NewMemoryProvider(name)
+		case "file":
+			if provider, err = external.NewFileProvider(name, externalProviderDir); err != nil {
+				setupLog.Error(err, "unable to create external resource provider", "provider", name)
+				os.Exit(1)
+			}
+		default:
+			setupLog.Error(fmt.Errorf("unknown external resource provider %q", name), "unable to create external resource provider")
+			os.Exit(1)
+		}
+		if err = providers.Register(provider); err != nil {
+			setupLog.Error(err, "unable to register external resource provider", "provider", name)
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controller.AppReconciler{
 		// 将 Manager 的 Client 传给 client-go-Controller，
 		// ClusterBuilder 参 数 的 类 型 为 ClientBuilder 接 口，Manager 会 调 用 此 接 口 创 建 Client， 即 Manager.GetClient() 返 回 的 Client。 在 默 认 情 况 下，Manager 使 用 pkg/ cluster 下的 newClientBuilder 对象创建 Client。
 		// 这个方法的实质过程是通过 k8s 的 kubeconfig 文件生成可访问的 restClient 对象，因此，它具备了对 k8s 所有资源的操作方法， 即 CRUD 的过程。
-		Client: mgr.GetClient(),
+		// 每次 API 调用都记录为 Reconcile span 的子 span
+		Client: tracing.WrapClient(mgr.GetClient()),
 		Scheme: mgr.GetScheme(),
+		// 不经过缓存直接读取 apiserver，用于读取只缓存了元数据的 ConfigMap 和 Secret
+		APIReader: mgr.GetAPIReader(),
+		// 外部资源的 provider，在 Reconcile 和删除 App 时调用
+		Providers: providers,
+		// Event 记录清理失败、强制释放等操作，kubectl describe app 可以看到
+		Recorder:       mgr.GetEventRecorderFor("app-controller"),
+		CleanupTimeout: cleanupTimeout,
+		// 并发数和限流参数在 SetupWithManager 中读取，feature gate 和默认策略在每次 Reconcile 时读取
+		Config: configStore,
 		// 并且调用 SetupWithManager 方法传入 Manager 进行 client-go-Controller 的初始化
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "App")
 		os.Exit(1)
 	}
+	// 本地 make run 时没有证书，可以通过 ENABLE_WEBHOOKS=false 关闭 webhook
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		// v1 是 Hub 版本，v1beta1 实现了 Convertible，注册后 manager 会在 /convert 上提供转换 webhook
+		defaultPolicies := func() (aloysv1.DeletionPolicy, aloysv1.DriftPolicy) {
+			defaults := configStore.Get().Defaults
+			return defaults.DeletionPolicy, defaults.DriftPolicy
+		}
+		if err = (&aloysv1.App{}).SetupWebhookWithManager(mgr, defaultPolicies); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "App")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
+	// 修改配置文件后重新加载 feature gate 和默认策略，不需要重启 manager
+	if configFile != "" {
+		if err := mgr.Add(config.NewReloader(configFile, configData, configStore)); err != nil {
+			setupLog.Error(err, "unable to set up the configuration reloader")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -208,3 +322,21 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// cacheOptions returns the options of the cache of the manager from the operator configuration.
+func cacheOptions(cfg config.CacheConfig) cache.Options {
+	opts := cache.Options{
+		SyncPeriod: &cfg.SyncPeriod.Duration,
+		// 只缓存 App 的 Pod，集群中其他的 Pod 不会常驻内存
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Pod{}: {Label: controller.PodCacheSelector()},
+		},
+	}
+	if len(cfg.Namespaces) > 0 {
+		opts.DefaultNamespaces = make(map[string]cache.Config, len(cfg.Namespaces))
+		for _, ns := range cfg.Namespaces {
+			opts.DefaultNamespaces[ns] = cache.Config{}
+		}
+	}
+	return opts
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// Load reads and validates the configuration file at path. It also returns the content of the
+// file, which NewReloader compares the file with to detect the changes made after Load.
+func Load(path string) (*OperatorConfig, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read the configuration file: %w", err)
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return cfg, data, nil
+}
+
+// Parse decodes and validates a configuration file. The fields it leaves out keep their
+// DefaultOperatorConfig value; unknown fields are rejected so that a typo does not go unnoticed.
+func Parse(data []byte) (*OperatorConfig, error) {
+	cfg := DefaultOperatorConfig()
+	// 在默认配置上解码，featureGates 只覆盖文件中列出的 gate
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration and returns all the invalid fields at once.
+func (c *OperatorConfig) Validate() error {
+	var errs field.ErrorList
+	if c.APIVersion != APIVersion {
+		errs = append(errs, field.NotSupported(field.NewPath("apiVersion"), c.APIVersion, []string{APIVersion}))
+	}
+	if c.Kind != Kind {
+		errs = append(errs, field.NotSupported(field.NewPath("kind"), c.Kind, []string{Kind}))
+	}
+
+	if c.LeaderElection.ResourceName == "" {
+		errs = append(errs, field.Required(field.NewPath("leaderElection", "resourceName"), ""))
+	}
+
+	ctrlPath := field.NewPath("controller")
+	if c.Controller.MaxConcurrentReconciles < 1 {
+		errs = append(errs, field.Invalid(ctrlPath.Child("maxConcurrentReconciles"), c.Controller.MaxConcurrentReconciles, "must be at least 1"))
+	}
+	rl, rlPath := c.Controller.RateLimiter, ctrlPath.Child("rateLimiter")
+	if rl.BaseDelay.Duration <= 0 {
+		errs = append(errs, field.Invalid(rlPath.Child("baseDelay"), rl.BaseDelay.Duration.String(), "must be positive"))
+	}
+	if rl.MaxDelay.Duration < rl.BaseDelay.Duration {
+		errs = append(errs, field.Invalid(rlPath.Child("maxDelay"), rl.MaxDelay.Duration.String(), "must not be less than baseDelay"))
+	}
+	if rl.QPS <= 0 {
+		errs = append(errs, field.Invalid(rlPath.Child("qps"), rl.QPS, "must be positive"))
+	}
+	if rl.Burst < 1 {
+		errs = append(errs, field.Invalid(rlPath.Child("burst"), rl.Burst, "must be at least 1"))
+	}
+
+	cachePath := field.NewPath("cache")
+	if c.Cache.SyncPeriod.Duration <= 0 {
+		errs = append(errs, field.Invalid(cachePath.Child("syncPeriod"), c.Cache.SyncPeriod.Duration.String(), "must be positive"))
+	}
+	seen := sets.New[string]()
+	for i, ns := range c.Cache.Namespaces {
+		p := cachePath.Child("namespaces").Index(i)
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			errs = append(errs, field.Invalid(p, ns, msg))
+		}
+		if seen.Has(ns) {
+			errs = append(errs, field.Duplicate(p, ns))
+		}
+		seen.Insert(ns)
+	}
+
+	for _, name := range sets.List(sets.KeySet(c.FeatureGates)) {
+		if _, ok := knownFeatureGates[name]; !ok {
+			errs = append(errs, field.NotSupported(field.NewPath("featureGates").Key(name), name, sets.List(sets.KeySet(knownFeatureGates))))
+		}
+	}
+
+	defaultsPath := field.NewPath("defaults")
+	switch c.Defaults.DeletionPolicy {
+	case aloysv1.DeletionPolicyDelete, aloysv1.DeletionPolicyOrphan, aloysv1.DeletionPolicyRetain:
+	default:
+		errs = append(errs, field.NotSupported(defaultsPath.Child("deletionPolicy"), c.Defaults.DeletionPolicy,
+			sortedStrings(aloysv1.DeletionPolicyDelete, aloysv1.DeletionPolicyOrphan, aloysv1.DeletionPolicyRetain)))
+	}
+	switch c.Defaults.DriftPolicy {
+	case aloysv1.DriftPolicyCorrect, aloysv1.DriftPolicyReport:
+	default:
+		errs = append(errs, field.NotSupported(defaultsPath.Child("driftPolicy"), c.Defaults.DriftPolicy,
+			sortedStrings(aloysv1.DriftPolicyCorrect, aloysv1.DriftPolicyReport)))
+	}
+	return errs.ToAggregate()
+}
+
+// FeatureEnabled reports whether the named feature gate is enabled.
+func (c *OperatorConfig) FeatureEnabled(name string) bool {
+	if enabled, ok := c.FeatureGates[name]; ok {
+		return enabled
+	}
+	return knownFeatureGates[name]
+}
+
+func sortedStrings[T ~string](values ...T) []string {
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		s = append(s, string(v))
+	}
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+const header = `apiVersion: config.aloys.tech/v1alpha1
+kind: OperatorConfig
+`
+
+var _ = Describe("OperatorConfig", func() {
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "config.yaml")
+	})
+
+	writeConfig := func(content string) {
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+	}
+
+	It("should keep the defaults of the fields left out of the file", func() {
+		writeConfig(header + `
+controller:
+  maxConcurrentReconciles: 4
+  rateLimiter:
+    maxDelay: 5m
+cache:
+  syncPeriod: 1h
+  namespaces: [team-a, team-b]
+featureGates:
+  AutoRollback: false
+defaults:
+  driftPolicy: Report
+`)
+		cfg, _, err := Load(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.LeaderElection.ResourceName).To(Equal("ada94d48.aloys.tech"))
+		Expect(cfg.Controller.MaxConcurrentReconciles).To(Equal(4))
+		Expect(cfg.Controller.RateLimiter.BaseDelay.Duration).To(Equal(5 * time.Millisecond))
+		Expect(cfg.Controller.RateLimiter.MaxDelay.Duration).To(Equal(5 * time.Minute))
+		Expect(cfg.Controller.RateLimiter.Burst).To(Equal(100))
+		Expect(cfg.Cache.SyncPeriod.Duration).To(Equal(time.Hour))
+		Expect(cfg.Cache.Namespaces).To(Equal([]string{"team-a", "team-b"}))
+		Expect(cfg.FeatureEnabled(FeatureAutoRollback)).To(BeFalse())
+		Expect(cfg.FeatureEnabled(FeatureDriftDetection)).To(BeTrue())
+		Expect(cfg.Defaults.DeletionPolicy).To(Equal(aloysv1.DeletionPolicyDelete))
+		Expect(cfg.Defaults.DriftPolicy).To(Equal(aloysv1.DriftPolicyReport))
+	})
+
+	It("should report every invalid field", func() {
+		writeConfig(`apiVersion: config.aloys.tech/v1
+kind: OperatorConfig
+controller:
+  maxConcurrentReconciles: 0
+  rateLimiter:
+    baseDelay: 1m
+    maxDelay: 1s
+cache:
+  namespaces: [team-a, Team_B, team-a]
+featureGates:
+  Canary: true
+defaults:
+  deletionPolicy: Keep
+`)
+		_, _, err := Load(path)
+		Expect(err).To(HaveOccurred())
+		for _, msg := range []string{
+			"apiVersion", "controller.maxConcurrentReconciles", "controller.rateLimiter.maxDelay",
+			"cache.namespaces[1]", "Duplicate value", "featureGates[Canary]", "defaults.deletionPolicy",
+		} {
+			Expect(err.Error()).To(ContainSubstring(msg))
+		}
+	})
+
+	It("should reject unknown fields", func() {
+		writeConfig(header + "controller:\n  maxConcurrentReconcile: 4\n")
+		_, _, err := Load(path)
+		Expect(err).To(MatchError(ContainSubstring("maxConcurrentReconcile")))
+	})
+
+	It("should return the defaults from a nil Store", func() {
+		var store *Store
+		Expect(store.Get()).To(Equal(DefaultOperatorConfig()))
+		Expect(store.FeatureEnabled(FeatureAutoRollback)).To(BeTrue())
+	})
+
+	It("should only reload the file once it differs from the loaded one", func() {
+		writeConfig(header)
+		cfg, data, err := Load(path)
+		Expect(err).NotTo(HaveOccurred())
+		store := NewStore(cfg)
+		reloader := NewReloader(path, data, store)
+
+		reloader.reload()
+		Expect(store.Get()).To(BeIdenticalTo(cfg))
+
+		By("Reloading a change made before the Reloader started")
+		writeConfig(header + "defaults:\n  driftPolicy: Report\n")
+		reloader.reload()
+		Expect(store.Get().Defaults.DriftPolicy).To(Equal(aloysv1.DriftPolicyReport))
+	})
+
+	Context("With a Reloader", func() {
+		var store *Store
+		var cancel context.CancelFunc
+
+		BeforeEach(func() {
+			writeConfig(header)
+			cfg, data, err := Load(path)
+			Expect(err).NotTo(HaveOccurred())
+			store = NewStore(cfg)
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			reloader := NewReloader(path, data, store)
+			reloader.Interval = 10 * time.Millisecond
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				Expect(reloader.Start(ctx)).To(Succeed())
+			}()
+			DeferCleanup(func() {
+				cancel()
+				Eventually(done).Should(BeClosed())
+			})
+		})
+
+		It("should reload the feature gates and the default policies", func() {
+			writeConfig(header + "featureGates:\n  DriftDetection: false\ndefaults:\n  deletionPolicy: Orphan\n")
+			Eventually(func() bool { return store.FeatureEnabled(FeatureDriftDetection) }).Should(BeFalse())
+			Expect(store.Get().Defaults.DeletionPolicy).To(Equal(aloysv1.DeletionPolicyOrphan))
+		})
+
+		It("should keep the settings that require a restart", func() {
+			writeConfig(header + "controller:\n  maxConcurrentReconciles: 8\ndefaults:\n  driftPolicy: Report\n")
+			Eventually(func() aloysv1.DriftPolicy { return store.Get().Defaults.DriftPolicy }).Should(Equal(aloysv1.DriftPolicyReport))
+			Expect(store.Get().Controller.MaxConcurrentReconciles).To(Equal(2))
+		})
+
+		It("should keep the current configuration when the file is invalid", func() {
+			writeConfig(header + "defaults:\n  driftPolicy: Ignore\n")
+			Consistently(func() aloysv1.DriftPolicy { return store.Get().Defaults.DriftPolicy }, 100*time.Millisecond).
+				Should(Equal(aloysv1.DriftPolicyCorrect))
+
+			By("Reloading the file once it is fixed")
+			writeConfig(header + "defaults:\n  driftPolicy: Report\n")
+			Eventually(func() aloysv1.DriftPolicy { return store.Get().Defaults.DriftPolicy }).Should(Equal(aloysv1.DriftPolicyReport))
+		})
+	})
+})
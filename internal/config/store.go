@@ -0,0 +1,137 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/wait"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// DefaultReloadInterval is how often the Reloader checks the configuration file for changes.
+const DefaultReloadInterval = 10 * time.Second
+
+var configlog = logf.Log.WithName("config")
+
+// defaultConfig is returned by a nil Store.
+var defaultConfig = DefaultOperatorConfig()
+
+// Store holds the current configuration of the operator. It is safe for concurrent use.
+// A nil Store returns the DefaultOperatorConfig.
+type Store struct {
+	current atomic.Pointer[OperatorConfig]
+}
+
+// NewStore returns a Store holding cfg.
+func NewStore(cfg *OperatorConfig) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+// Get returns the current configuration. It must not be modified.
+func (s *Store) Get() *OperatorConfig {
+	if s == nil {
+		return defaultConfig
+	}
+	return s.current.Load()
+}
+
+// FeatureEnabled reports whether the named feature gate is currently enabled.
+func (s *Store) FeatureEnabled(name string) bool {
+	return s.Get().FeatureEnabled(name)
+}
+
+// Reloader watches the configuration file and updates the Store with the settings that can
+// change while the manager is running, i.e. the feature gates and the default policies.
+// Changes of the other settings are only logged since they take effect after a restart.
+// It is created with NewReloader.
+// 挂载 ConfigMap 的文件由 kubelet 通过替换符号链接更新，轮询文件内容比 inotify 更可靠
+type Reloader struct {
+	// Path is the path of the configuration file.
+	Path string
+	// Store is updated with the reloaded configuration.
+	Store *Store
+	// Interval is how often the file is read. Zero means DefaultReloadInterval.
+	Interval time.Duration
+
+	// last 是最近一次读取到的文件内容，内容不变时不重复解析和打印日志
+	last []byte
+}
+
+var _ manager.LeaderElectionRunnable = &Reloader{}
+
+// NewReloader returns a Reloader of the configuration file at path. data is the content the
+// configuration in store was loaded from: the file is only reloaded once it differs, including
+// when it changed between the load and the start of the Reloader.
+func NewReloader(path string, data []byte, store *Store) *Reloader {
+	return &Reloader{Path: path, Store: store, last: data}
+}
+
+// Start implements manager.Runnable. It checks the file every Interval until ctx is done.
+func (r *Reloader) Start(ctx context.Context) error {
+	interval := r.Interval
+	if interval == 0 {
+		interval = DefaultReloadInterval
+	}
+	wait.UntilWithContext(ctx, func(context.Context) { r.reload() }, interval)
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Every replica reloads its
+// configuration, the webhooks of the standby replicas use the default policies as well.
+func (r *Reloader) NeedLeaderElection() bool {
+	return false
+}
+
+// reload reads the configuration file and stores it when it changed and is valid. An invalid
+// file is reported and the current configuration is kept.
+func (r *Reloader) reload() {
+	data, err := os.ReadFile(r.Path)
+	if err != nil {
+		configlog.Error(err, "unable to read the configuration file, keeping the current configuration", "path", r.Path)
+		return
+	}
+	if bytes.Equal(data, r.last) {
+		return
+	}
+	r.last = data
+
+	next, err := Parse(data)
+	if err != nil {
+		configlog.Error(err, "invalid configuration file, keeping the current configuration", "path", r.Path)
+		return
+	}
+	// 只能在创建 manager 时生效的配置保留当前的值，等重启后再生效
+	cur := r.Store.Get()
+	if !equality.Semantic.DeepEqual(next.LeaderElection, cur.LeaderElection) ||
+		!equality.Semantic.DeepEqual(next.Controller, cur.Controller) ||
+		!equality.Semantic.DeepEqual(next.Cache, cur.Cache) {
+		configlog.Info("leaderElection, controller and cache settings changed, they take effect after a restart", "path", r.Path)
+	}
+	next.LeaderElection, next.Controller, next.Cache = cur.LeaderElection, cur.Controller, cur.Cache
+	r.Store.current.Store(next)
+	configlog.Info("reloaded the configuration", "path", r.Path,
+		"featureGates", next.FeatureGates, "defaults", next.Defaults)
+}
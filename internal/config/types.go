@@ -0,0 +1,141 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config loads the configuration file of the operator and reloads the settings
+// that can change while the manager is running.
+package config
+
+import (
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// APIVersion and Kind of the configuration file.
+const (
+	APIVersion = "config.aloys.tech/v1alpha1"
+	Kind       = "OperatorConfig"
+)
+
+// Feature gates of the operator. They are enabled unless the configuration file disables them.
+const (
+	// FeatureAutoRollback reverts a failing rollout to the last healthy revision of the App.
+	FeatureAutoRollback = "AutoRollback"
+	// FeatureDriftDetection compares the child resources with what was last applied and reports
+	// or corrects the changes made outside of the App according to spec.driftPolicy.
+	FeatureDriftDetection = "DriftDetection"
+)
+
+// knownFeatureGates are the feature gates the operator understands with their default state.
+var knownFeatureGates = map[string]bool{
+	FeatureAutoRollback:   true,
+	FeatureDriftDetection: true,
+}
+
+// OperatorConfig is the configuration file of the operator.
+// LeaderElection、Controller 和 Cache 在创建 manager 时使用，修改后需要重启；FeatureGates 和 Defaults 运行时重新加载
+type OperatorConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// LeaderElection configures the leader election of the managers. Changes require a restart.
+	LeaderElection LeaderElectionConfig `json:"leaderElection,omitempty"`
+	// Controller configures the App controller. Changes require a restart.
+	Controller ControllerConfig `json:"controller,omitempty"`
+	// Cache configures the informers of the manager. Changes require a restart.
+	Cache CacheConfig `json:"cache,omitempty"`
+	// FeatureGates enables or disables the features of the operator by name. Changes are reloaded.
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// Defaults are the policies of the Apps that do not set them. Changes are reloaded, but only
+	// apply to the Apps created afterwards, see DefaultsConfig.
+	Defaults DefaultsConfig `json:"defaults,omitempty"`
+}
+
+// LeaderElectionConfig configures the leader election of the managers.
+type LeaderElectionConfig struct {
+	// ResourceName is the name of the Lease the managers compete for.
+	ResourceName string `json:"resourceName,omitempty"`
+}
+
+// ControllerConfig configures the App controller.
+type ControllerConfig struct {
+	// MaxConcurrentReconciles is the number of Apps reconciled in parallel.
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+	// RateLimiter limits how fast the Apps are requeued.
+	RateLimiter RateLimiterConfig `json:"rateLimiter,omitempty"`
+}
+
+// RateLimiterConfig configures the rate limiter of the work queue of the controller. The delay of
+// a requeue is the larger of the per-App exponential backoff and of the overall token bucket.
+type RateLimiterConfig struct {
+	// BaseDelay is the delay of the first retry of a failing App, doubled on every failure.
+	BaseDelay metav1.Duration `json:"baseDelay,omitempty"`
+	// MaxDelay caps the delay of the retries of a failing App.
+	MaxDelay metav1.Duration `json:"maxDelay,omitempty"`
+	// QPS is the overall rate of the requeues.
+	QPS float64 `json:"qps,omitempty"`
+	// Burst is the number of requeues allowed above QPS.
+	Burst int `json:"burst,omitempty"`
+}
+
+// CacheConfig configures the informers of the manager.
+type CacheConfig struct {
+	// SyncPeriod is how often every watched object is reconciled again even without changes.
+	SyncPeriod metav1.Duration `json:"syncPeriod,omitempty"`
+	// Namespaces restricts the operator to the Apps of these namespaces. All namespaces are
+	// watched when it is empty.
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+// DefaultsConfig are the policies of the Apps that do not set them. The defaulting webhook writes
+// them into the spec when an App is created or updated, so changing them does not change the
+// existing Apps: an App keeps the policies it was admitted with until they are set explicitly.
+type DefaultsConfig struct {
+	// DeletionPolicy is the default spec.deletionPolicy.
+	DeletionPolicy aloysv1.DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// DriftPolicy is the default spec.driftPolicy.
+	DriftPolicy aloysv1.DriftPolicy `json:"driftPolicy,omitempty"`
+}
+
+// DefaultOperatorConfig returns the configuration used when no configuration file is given.
+// The fields left out of a configuration file keep these values.
+// 和引入配置文件之前硬编码的值保持一致，限流参数与 client-go 的 DefaultControllerRateLimiter 相同
+func DefaultOperatorConfig() *OperatorConfig {
+	gates := make(map[string]bool, len(knownFeatureGates))
+	for name, enabled := range knownFeatureGates {
+		gates[name] = enabled
+	}
+	return &OperatorConfig{
+		TypeMeta:       metav1.TypeMeta{APIVersion: APIVersion, Kind: Kind},
+		LeaderElection: LeaderElectionConfig{ResourceName: "ada94d48.aloys.tech"},
+		Controller: ControllerConfig{
+			MaxConcurrentReconciles: 2,
+			RateLimiter: RateLimiterConfig{
+				BaseDelay: metav1.Duration{Duration: 5 * time.Millisecond},
+				MaxDelay:  metav1.Duration{Duration: 1000 * time.Second},
+				QPS:       10,
+				Burst:     100,
+			},
+		},
+		Cache:        CacheConfig{SyncPeriod: metav1.Duration{Duration: 10 * time.Hour}},
+		FeatureGates: gates,
+		Defaults: DefaultsConfig{
+			DeletionPolicy: aloysv1.DeletionPolicyDelete,
+			DriftPolicy:    aloysv1.DriftPolicyCorrect,
+		},
+	}
+}
@@ -18,17 +18,41 @@ package controller
 
 import (
 	"context"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
-	"kubebuilder-demo1/api/v1beta1"
-	aloysv1beta1 "kubebuilder-demo1/api/v1beta1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	aloysv1 "kubebuilder-demo1/api/v1"
+	"kubebuilder-demo1/internal/config"
+	"kubebuilder-demo1/internal/external"
+	"kubebuilder-demo1/internal/tracing"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+const (
+	// appFinalizer 保证 App 被删除之前按照 spec.deletionPolicy 处理完子资源和外部资源
+	// 自定义 Finalizer 的标识符包含一个域名、一个正向斜线和 Finalizer 的名称
+	appFinalizer = "aloys.tech/finalizer"
+	// legacyFinalizer 是早期版本从 kubebuilder 教程中复制过来的 finalizer，Reconcile 时会被替换为 appFinalizer
+	legacyFinalizer = "storage.finalizers.tutorial.kubebuilder.io"
+)
+
 // controller实现业务需求，在operator开发过程中，尽管业务逻辑各不相同，但有两个共性
 // Status(真实状态)是个数据结构，其字段是业务定义的，其字段值也是业务代码执行自定义的逻辑算出来的；
 // 业务核心的目标，是确保Status与Spec达成一致，例如deployment指定了pod的副本数为3，如果真实的pod没有三个，deployment的controller代码就去创建pod，如果真实的pod超过了三个，deployment的controller代码就去删除pod;
@@ -39,11 +63,38 @@ type AppReconciler struct {
 	// 这里 Client 的作用比较清晰，就是在 CRD client-go-Controller 执行协调的过程中，需要通过 ClientCRUD(Create、Retrieve、Update、Delete)CRD，即 Get、Create 等方法。所以 DemoReconciler 的结构体第一个元素的对象，指向的是 client-go-Controller-runtime 包中的 Client 接口对象，它设计了必要的方法，如 Get、List、Update 等
 	client.Client
 	Scheme *runtime.Scheme
+	// APIReader reads from the apiserver without going through the informer cache. It may be nil,
+	// the Client is used then.
+	APIReader client.Reader
+	// Providers manage the resources of the Apps outside the cluster. It may be nil.
+	Providers *external.Registry
+	// Recorder records the Events of the Apps. It may be nil.
+	Recorder record.EventRecorder
+	// CleanupTimeout is how long the cleanup of a deleted App may take before the CleanupStalled
+	// condition is set. Zero means defaultCleanupTimeout.
+	CleanupTimeout time.Duration
+	// Config is the configuration of the operator, with the feature gates and the default
+	// policies reloaded at runtime. It may be nil, the defaults are used then.
+	Config *config.Store
+
+	// events 对 Recorder 记录的 Event 去重和限流
+	events eventLimiter
+	// configHashes 缓存每个 App 引用的 ConfigMap 和 Secret 的 hash，resourceVersion 不变时不再读取内容
+	configHashes configHashCache
 }
 
 // +kubebuilder:rbac:groups=aloys.aloys.tech,resources=apps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=aloys.aloys.tech,resources=apps/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=aloys.aloys.tech,resources=apps/finalizers,verbs=update
+// +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=controllerrevisions,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=autoscaling,resources=horizontalpodautoscalers,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=configmaps;secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=list;patch;delete
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -79,47 +130,233 @@ type AppReconciler struct {
 // (3)提供了待处理对象的 Name 和 Namespace。
 // (4)协调者不关心负责触发协调的事件内容或事件类型。无论是对象的增加、删除还 是更新操作，Reconciler 中接收的都是对象的名称和命名空间。
 // https://zhuanlan.zhihu.com/p/628496918
-func (r *AppReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = log.FromContext(ctx)
+func (r *AppReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	// 每次 Reconcile 是一个 span，各个阶段和 API 调用是它的子 span；日志中带上 trace ID，方便和 span 对应起来
+	ctx, span := tracer.Start(ctx, "Reconcile", trace.WithAttributes(
+		attribute.String("app.namespace", req.Namespace), attribute.String("app.name", req.Name)))
+	logger := tracing.LoggerWithTraceID(ctx, log.FromContext(ctx))
+	ctx = log.IntoContext(ctx, logger)
+	defer func() { tracing.End(span, err) }()
+	// 多个 worker 同时运行，对象可能在读取之后被其他 worker 或用户修改
+	// 冲突时重新入队，用最新的对象再 Reconcile 一次，不作为错误记录
+	defer func() {
+		if apierrors.IsConflict(err) {
+			logger.V(1).Info("object was modified concurrently, requeuing", "reason", err.Error())
+			result, err = ctrl.Result{Requeue: true}, nil
+		}
+	}()
 
 	// TODO(user): your logic here
-	app := &v1beta1.App{}
+	app := &aloysv1.App{}
 	// 从缓存中获取app
 	if err := r.Get(ctx, req.NamespacedName, app); err != nil {
+		if apierrors.IsNotFound(err) {
+			// App 已经被删除，不再上报它的指标，也不再缓存它的 config hash
+			forgetAppMetrics(req.NamespacedName)
+			r.configHashes.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	// 声明 Finalizer 字段，由前文可知，类型为字符串
-	// 自定义 Finalizer 的标识符包含一个域名、一个正向斜线和 Finalizer 的名称
-	myFinalizerName := "storage.finalizers.tutorial.kubebuilder.io"
 	// 通过检查 DeletionTimestamp 字段是否为0，判断资源是否被删除
 	if app.ObjectMeta.DeletionTimestamp.IsZero() {
 		// 如果 DeletionTimestamp 字段为0 ，说明资源未被删除，此时需要检测是否存在 Finalizer，如果不存在，则添加，并更新到资源对象中
-		if !containsString(app.ObjectMeta.Finalizers, myFinalizerName) {
-			app.ObjectMeta.Finalizers = append(app.ObjectMeta.
-				Finalizers, myFinalizerName)
-			if err := r.Update(context.Background(), app); err != nil {
+		// 带有旧 finalizer 的 App 在同一次 Update 中换成新的 finalizer，任何时候 App 上都至少有一个 finalizer
+		if !containsString(app.ObjectMeta.Finalizers, appFinalizer) || containsString(app.ObjectMeta.Finalizers, legacyFinalizer) {
+			err := r.patchApp(ctx, app, func(app *aloysv1.App) {
+				app.ObjectMeta.Finalizers = append(removeString(removeString(app.ObjectMeta.
+					Finalizers, legacyFinalizer), appFinalizer), appFinalizer)
+			})
+			if err != nil {
 				return ctrl.Result{}, err
 			}
+			r.eventf(app, corev1.EventTypeNormal, eventFinalizerAdded, "Added finalizer %s", appFinalizer)
 		}
 	} else {
 		// 如果DeletionTimestamp 字段不为 0 ，说明对象处于删除状态中
-		if containsString(app.ObjectMeta.Finalizers, myFinalizerName) {
-			// 如果存在 Finalizer 且与上述声明的 finalizer 匹配，那么执行对应的 hook 逻
-			if err := r.deleteExternalResources(app); err != nil {
-				// 如果删除失败，则直接返回对应的 err，client-go-Controller 会自动执行重试逻辑
-				return ctrl.Result{}, err
-			}
-			// 如果对应的 hook 执行成功，那么清空 finalizers，Kuebernetes删除对应资源
-			app.ObjectMeta.Finalizers = removeString(app.ObjectMeta.
-				Finalizers, myFinalizerName)
-			if err := r.Update(context.Background(), app); err != nil {
-				return ctrl.Result{}, err
-			}
+		// 还没来得及迁移就被删除的 App 只带有旧的 finalizer，同样需要执行清理
+		if containsString(app.ObjectMeta.Finalizers, appFinalizer) || containsString(app.ObjectMeta.Finalizers, legacyFinalizer) {
+			// 如果存在 Finalizer 且与上述声明的 finalizer 匹配，那么按照 spec.deletionPolicy 处理子资源和外部资源
+			// 清理失败时 client-go-Controller 会自动执行重试逻辑，每次尝试记录在 status.cleanup 中
+			err := runPhase(ctx, phaseCleanup, func(ctx context.Context) (err error) {
+				result, err = r.reconcileDelete(ctx, app)
+				return err
+			})
+			return result, err
+		}
+		// 对象正在删除，不再创建或更新子资源
+		return ctrl.Result{}, nil
+	}
+
+	// 暂停期间不修改任何子资源，也不处理 rollbackTo 和 canary 的注解，只更新 Paused condition 和指标
+	if isPaused(app) {
+		logger.Info("App is paused, skipping reconcile")
+		return ctrl.Result{}, r.updatePausedStatus(ctx, app)
+	}
+
+	// spec.rollbackTo 只修改 spec，更新后会触发新的 Reconcile，按照回滚后的 spec 发布
+	if app.Spec.RollbackTo != nil {
+		return ctrl.Result{}, r.rollback(ctx, app)
+	}
+
+	// 创建或更新子资源，然后根据子资源的状态重新计算 App 的 status
+	children, err := r.reconcileChildren(ctx, app)
+	if apierrors.IsConflict(err) {
+		// 冲突只是暂时的，不记录到 Degraded condition 中
+		return ctrl.Result{}, err
+	}
+	if statusErr := runPhase(ctx, phaseStatus, func(ctx context.Context) error {
+		return r.updateStatus(ctx, app, children, err)
+	}); statusErr != nil {
+		logger.Error(statusErr, "unable to update App status")
+		if err == nil {
+			err = statusErr
 		}
 	}
+	if err != nil {
+		r.warningf(app, eventReconcileFailed, "%v", err)
+		return ctrl.Result{}, err
+	}
 	// ctrl.Result{true} 表示从新入队，不是进行重试，如果不设置，失败是进行重试的
-	return ctrl.Result{}, nil
+	// canary 的暂停时间通过 RequeueAfter 实现
+	return ctrl.Result{RequeueAfter: children.requeueAfter}, nil
+}
+
+// appChildren holds the child resources of an App observed during a reconcile.
+type appChildren struct {
+	// deployment is the Deployment serving the App: the stable one, or the active color in blue/green mode.
+	deployment       *appsv1.Deployment
+	canaryDeployment *appsv1.Deployment
+	// previewDeployment is the Deployment of the preview color in blue/green mode.
+	previewDeployment *appsv1.Deployment
+	hpa               *autoscalingv2.HorizontalPodAutoscaler
+	// canaryStatus is the progress of the canary rollout, written to status.canary.
+	canaryStatus *aloysv1.CanaryStatus
+	// blueGreenStatus holds the colors of the blue/green rollout, written to status.blueGreen.
+	blueGreenStatus *aloysv1.BlueGreenStatus
+	// revision is the ControllerRevision matching the current workload spec.
+	revision *appsv1.ControllerRevision
+	// failure is set when the pods or Deployments of the App are failing.
+	failure *workloadFailure
+	// externalResources are the resources managed by the external resource providers, written to status.externalResources.
+	externalResources []aloysv1.ExternalResourceStatus
+	// drift lists the child resources found changed outside of the App during the reconcile, written to status.drift.
+	drift []aloysv1.ResourceDrift
+	// rollback is set when a failed rollout was rolled back during the reconcile, written to status.lastRollback.
+	rollback *aloysv1.RollbackStatus
+	// requeueAfter is set when the rollout has to be revisited after a delay.
+	requeueAfter time.Duration
+}
+
+// reconcileChildren creates, updates or deletes the child resources of the App.
+// 返回的子资源用于计算 status，即使后续步骤出错也会返回已经处理过的子资源
+func (r *AppReconciler) reconcileChildren(ctx context.Context, app *aloysv1.App) (*appChildren, error) {
+	children := &appChildren{
+		externalResources: append([]aloysv1.ExternalResourceStatus(nil), app.Status.ExternalResources...),
+	}
+	// 每个阶段的耗时记录在 app_reconcile_phase_duration_seconds 中
+	// 记录当前 workload spec 对应的 revision，用于回滚
+	err := runPhase(ctx, phaseRevision, func(ctx context.Context) (err error) {
+		children.revision, err = r.reconcileRevision(ctx, app)
+		return err
+	})
+	if err != nil {
+		return children, err
+	}
+	err = runPhase(ctx, phaseWorkload, func(ctx context.Context) (err error) {
+		switch {
+		case isCanary(app):
+			// canary 发布：stable 和 canary 两个 Deployment 同时运行
+			children.canaryStatus = app.Status.Canary.DeepCopy()
+			err = r.reconcileCanary(ctx, app, children)
+		case isBlueGreen(app):
+			// blue/green 发布：新版本完全可用后再切换 Service
+			children.blueGreenStatus = app.Status.BlueGreen.DeepCopy()
+			err = r.reconcileBlueGreen(ctx, app, children)
+		default:
+			// 创建或更新 App 拥有的 Deployment
+			children.deployment, err = r.reconcileDeployment(ctx, app, children)
+		}
+		if err != nil {
+			return err
+		}
+		return r.cleanupStrategies(ctx, app, children)
+	})
+	if err != nil {
+		return children, err
+	}
+
+	// 根据 spec.service 创建、更新或删除 Service，blue/green 模式下只选中当前颜色的 Pod
+	err = runPhase(ctx, phaseService, func(ctx context.Context) error {
+		selector := selectorLabels(app)
+		if st := children.blueGreenStatus; st != nil && st.ActiveColor != "" {
+			selector = colorSelector(app, st.ActiveColor)
+		}
+		if _, err := r.reconcileService(ctx, app, children, selector); err != nil {
+			return err
+		}
+		return r.reconcilePreviewService(ctx, app, children)
+	})
+	if err != nil {
+		return children, err
+	}
+	// 根据 spec.ingress 创建、更新或删除 Ingress
+	err = runPhase(ctx, phaseIngress, func(ctx context.Context) error {
+		_, err := r.reconcileIngress(ctx, app, children)
+		return err
+	})
+	if err != nil {
+		return children, err
+	}
+	// 根据 spec.autoscaling 创建、更新或删除 HPA
+	err = runPhase(ctx, phaseAutoscaling, func(ctx context.Context) (err error) {
+		target := app.Name
+		if children.deployment != nil {
+			target = children.deployment.Name
+		} else if isBlueGreen(app) && app.Spec.Autoscaling != nil {
+			// 第一次 blue/green 发布还没有 active 颜色，preview 的副本数由控制器管理，
+			// 切换到 active 颜色之后再创建指向它的 HPA
+			return nil
+		}
+		children.hpa, err = r.reconcileHPA(ctx, app, children, target)
+		return err
+	})
+	if err != nil {
+		return children, err
+	}
+	// 通过注册的 provider 创建或更新集群外部的资源
+	err = runPhase(ctx, phaseExternalResources, func(ctx context.Context) error {
+		return r.reconcileExternalResources(ctx, app, children)
+	})
+	if err != nil {
+		return children, err
+	}
+	// 检查 Pod 和 Deployment 的健康状况，发布失败时自动回滚到最后一个健康的 revision
+	err = runPhase(ctx, phaseHealth, func(ctx context.Context) (err error) {
+		if children.failure, err = r.checkWorkload(ctx, app, children); err != nil {
+			return err
+		}
+		return r.autoRollback(ctx, app, children)
+	})
+	return children, err
+}
+
+// cleanupStrategies deletes the workloads left over by a previously used rollout strategy.
+// 切换策略时，等新的 Deployment 滚动完成后再删除旧的，避免服务中断
+func (r *AppReconciler) cleanupStrategies(ctx context.Context, app *aloysv1.App, children *appChildren) error {
+	if !isCanary(app) {
+		// 去掉 spec.strategy.canary 之后清理遗留的 canary Deployment
+		if err := r.deleteCanary(ctx, app); err != nil {
+			return err
+		}
+	}
+	if !deploymentRollout(children.deployment).complete {
+		return nil
+	}
+	if isBlueGreen(app) {
+		return r.deleteOwned(ctx, app, &appsv1.Deployment{}, types.NamespacedName{Namespace: app.Namespace, Name: app.Name})
+	}
+	return r.cleanupBlueGreen(ctx, app)
 }
 
 // 使用自定义的Event
@@ -147,10 +384,27 @@ func (fe filterEvent) Generic(event event.GenericEvent) bool {
 // ctrl.NewControllerManagedBy 方法实际借助 client-go-Controller-runtime 完成了 Builder 对象的构建，并借助（Complete）关联 CRD API 定 义的 Scheme 信息，从而得知 CRD 的 client-go-Controller 需要监听的 CRD 类型、版本等信息。这 个方法的最后一步是 Complete 的过程
 // Complete具体过程：在构建 client-go-Controller 的方法中最重要的两个步骤是 doController 和 doWatch。在 doController 的过程中，实际的核心步骤是完成 client-go-Controller 对象的构建，从而实现基于 Scheme 和 client-go-Controller 对象的 CRD 的监听流程。而在构建 client-go-Controller 的过程中，它的 do 字段实际对应的是 Reconciler 接口类型定义的方法，也就是在 client-go-Controller 对象生成之后， 必须实现这个定义的方法。它是如何使 Reconciler 对象同 client-go-Controller 产生联系的?实际上， 在 client-go-Controller 初始化的过程中，借助了 Options 参数对象中设计的 Reconciler 对象，并将 其传递给了 client-go-Controller 对象的 do 字段。所以当我们调用 SetupWithManager 方法的时候， 不仅完成了 client-go-Controller 的初始化，还完成了 client-go-Controller 监听资源的注册与发现过程（doWatch），同时 将 CRD 的必要实现方法(Reconcile 方法)进行了再现。至此，我们完成了 client-go-Controller 的 初始化分析，
 func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// 为 App 引用的 ConfigMap 和 Secret 建立索引，ConfigMap 或 Secret 变化时通过索引找到引用它的 App
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &aloysv1.App{}, configRefIndexKey, indexConfigRefs); err != nil {
+		return err
+	}
+
 	// 通过 ControllerManagedBy(m manager.Manager)*Builder 方法实例化一个 Builder 对象，其中传入的 Manager 提供创建 client-go-Controller 所需的依赖。
 	return ctrl.NewControllerManagedBy(mgr).
-		// For(&aloysv1beta1.App{}, builder.WithPredicates(filterEvent{})).
-		For(&aloysv1beta1.App{}).
+		// For(&aloysv1.App{}, builder.WithPredicates(filterEvent{})).
+		For(&aloysv1.App{}).
+		// App 拥有的 Deployment 发生变化时(比如被手动修改或删除)，根据 ownerReference 把对应的 App 加入队列
+		Owns(&appsv1.Deployment{}).
+		Owns(&corev1.Service{}).
+		Owns(&networkingv1.Ingress{}).
+		Owns(&autoscalingv2.HorizontalPodAutoscaler{}).
+		Owns(&appsv1.ControllerRevision{}).
+		// ConfigMap 和 Secret 不归 App 所有，需要通过 Watches 加上自定义的映射函数，把引用它们的 App 加入队列
+		// 只缓存元数据，集群中所有 ConfigMap 和 Secret 的内容不会常驻内存；内容变化同样会更新 resourceVersion 并触发事件
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.appsForConfig(configMapKind)), builder.OnlyMetadata).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.appsForConfig(secretKind)), builder.OnlyMetadata).
+		// Pod 进入 CrashLoopBackOff 或 ImagePullBackOff 时需要检查是否回滚
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(appForPod)).
 		// 其中For和Owns是等同与Watches。For的第二个参数默认为EnqueueRequestForObject。Owns的第二个参数默认为EnqueueRequestForOwner
 		// ControllerManagedBy(manager).
 		//        For(&appsv1.ReplicaSet{}).
@@ -196,13 +450,29 @@ func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		// (3)可以将一个事件映射为另一个不同类型对象的 Request。例如，将一个 Pod 事件 映射为一个纳管这个 Pod 的 ReplicaSet 类型 Request。
 		// (4)用户应该只使用提供的 Eventhandler 实现，而不是使用自定义 Eventhandler 实现。
 		// EventHandler就是当事件产生的时候，可以添加多个 Name 和 Namespace到队列进行处理
-		WithOptions(controller.Options{MaxConcurrentReconciles: 2}).
+		// 并发数和限流参数来自配置文件，只在创建 controller 时读取一次
+		WithOptions(r.controllerOptions()).
 		// WithOptions(controller.Options{CacheSyncTimeout: time.Microsecond * 100}).
 		// WithOptions(controller.Options{})
 
 		Complete(r)
 }
 
+// controllerOptions returns the concurrency and the rate limiter of the controller from the
+// configuration of the operator.
+// 与 workqueue.DefaultControllerRateLimiter 结构相同：单个 App 的指数退避和整体的令牌桶取较大的延迟
+func (r *AppReconciler) controllerOptions() controller.Options {
+	cfg := r.Config.Get().Controller
+	rl := cfg.RateLimiter
+	return controller.Options{
+		MaxConcurrentReconciles: cfg.MaxConcurrentReconciles,
+		RateLimiter: workqueue.NewMaxOfRateLimiter(
+			workqueue.NewItemExponentialFailureRateLimiter(rl.BaseDelay.Duration, rl.MaxDelay.Duration),
+			&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(rl.QPS), rl.Burst)},
+		),
+	}
+}
+
 func containsString(slice []string, s string) bool {
 	for _, item := range slice {
 		if item == s {
@@ -221,8 +491,3 @@ func removeString(slice []string, s string) (result []string) {
 	}
 	return
 }
-
-func (r *AppReconciler) deleteExternalResources(app *v1beta1.App) error {
-	// 删除 app关联的外部资源逻 需要确保实现是幂等的
-	return nil
-}
@@ -18,16 +18,38 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	aloysv1beta1 "kubebuilder-demo1/api/v1beta1"
+	aloysv1 "kubebuilder-demo1/api/v1"
+	"kubebuilder-demo1/internal/config"
+	"kubebuilder-demo1/internal/external"
+	"kubebuilder-demo1/internal/tracing"
 )
 
 var _ = Describe("App client-go-Controller", func() {
@@ -40,18 +62,28 @@ var _ = Describe("App client-go-Controller", func() {
 			Name:      resourceName,
 			Namespace: "default", // TODO(user):Modify as needed
 		}
-		app := &aloysv1beta1.App{}
+		app := &aloysv1.App{}
 
 		BeforeEach(func() {
 			By("creating the custom resource for the Kind App")
 			err := k8sClient.Get(ctx, typeNamespacedName, app)
 			if err != nil && errors.IsNotFound(err) {
-				resource := &aloysv1beta1.App{
+				resource := &aloysv1.App{
 					ObjectMeta: metav1.ObjectMeta{
 						Name:      resourceName,
 						Namespace: "default",
 					},
-					// TODO(user): Specify other spec details if needed.
+					Spec: aloysv1.AppSpec{
+						Image:    "nginx:1.25",
+						Replicas: ptr.To[int32](2),
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 80},
+						},
+						Env: []corev1.EnvVar{
+							{Name: "LOG_LEVEL", Value: "debug"},
+						},
+						Args: []string{"-g", "daemon off;"},
+					},
 				}
 				Expect(k8sClient.Create(ctx, resource)).To(Succeed())
 			}
@@ -59,12 +91,43 @@ var _ = Describe("App client-go-Controller", func() {
 
 		AfterEach(func() {
 			// TODO(user): Cleanup logic after each test, like removing the resource instance.
-			resource := &aloysv1beta1.App{}
+			resource := &aloysv1.App{}
 			err := k8sClient.Get(ctx, typeNamespacedName, resource)
 			Expect(err).NotTo(HaveOccurred())
 
 			By("Cleanup the specific resource instance App")
 			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+
+			// envtest 中没有运行 controller，需要手动 Reconcile 一次来执行 finalizer 逻辑
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(func() bool {
+				return errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &aloysv1.App{}))
+			}).Should(BeTrue())
+
+			// envtest 中也没有垃圾回收器，子资源需要手动清理
+			childMeta := metav1.ObjectMeta{Name: resourceName, Namespace: "default"}
+			for _, child := range []client.Object{
+				&appsv1.Deployment{ObjectMeta: childMeta},
+				&corev1.Service{ObjectMeta: childMeta},
+				&networkingv1.Ingress{ObjectMeta: childMeta},
+				&autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: childMeta},
+				&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-canary", Namespace: "default"}},
+				&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-blue", Namespace: "default"}},
+				&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-green", Namespace: "default"}},
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-preview", Namespace: "default"}},
+				&corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-data", Namespace: "default"}},
+			} {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, child))).To(Succeed())
+			}
+			Expect(k8sClient.DeleteAllOf(ctx, &appsv1.ControllerRevision{}, client.InNamespace("default"),
+				client.MatchingLabels{"aloys.tech/app": resourceName})).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &corev1.Pod{}, client.InNamespace("default"),
+				client.MatchingLabels{"aloys.tech/app": resourceName}, client.GracePeriodSeconds(0))).To(Succeed())
 		})
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
@@ -77,8 +140,1548 @@ var _ = Describe("App client-go-Controller", func() {
 				NamespacedName: typeNamespacedName,
 			})
 			Expect(err).NotTo(HaveOccurred())
-			// TODO(user): Add more specific assertions depending on your controller's reconciliation logic.
-			// Example: If you expect a certain status condition after reconciliation, verify it here.
+
+			By("Checking the Deployment owned by the App")
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Replicas).To(Equal(ptr.To[int32](2)))
+			Expect(deploy.Spec.Selector.MatchLabels).To(HaveKeyWithValue("aloys.tech/app", resourceName))
+			Expect(deploy.Spec.Selector.MatchLabels).To(HaveKeyWithValue("aloys.tech/track", "stable"))
+			Expect(deploy.Spec.Template.Labels).To(HaveKeyWithValue("aloys.tech/track", "stable"))
+			Expect(deploy.Spec.Template.Spec.Containers).To(HaveLen(1))
+			container := deploy.Spec.Template.Spec.Containers[0]
+			Expect(container.Image).To(Equal("nginx:1.25"))
+			Expect(container.Args).To(Equal([]string{"-g", "daemon off;"}))
+			Expect(container.Ports).To(HaveLen(1))
+			Expect(container.Ports[0].ContainerPort).To(Equal(int32(80)))
+			Expect(container.Env).To(ContainElement(corev1.EnvVar{Name: "LOG_LEVEL", Value: "debug"}))
+
+			owner := metav1.GetControllerOf(deploy)
+			Expect(owner).NotTo(BeNil())
+			Expect(owner.Kind).To(Equal("App"))
+			Expect(owner.Name).To(Equal(resourceName))
+		})
+
+		It("should update the Deployment when the App spec changes", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Changing the image and replicas of the App")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Image = "nginx:1.26"
+			resource.Spec.Replicas = ptr.To[int32](3)
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Replicas).To(Equal(ptr.To[int32](3)))
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.26"))
+		})
+
+		It("should manage the Service from spec.service", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+
+			By("Adding a service block to the App")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Service = &aloysv1.ServiceSpec{
+				Annotations: map[string]string{"example.com/team": "demo"},
+			}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			svc := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, svc)).To(Succeed())
+			Expect(svc.Spec.Type).To(Equal(corev1.ServiceTypeClusterIP))
+			Expect(svc.Spec.Selector).To(Equal(map[string]string{"aloys.tech/app": resourceName}))
+			Expect(svc.Annotations).To(HaveKeyWithValue("example.com/team", "demo"))
+			Expect(svc.Spec.Ports).To(HaveLen(1))
+			Expect(svc.Spec.Ports[0].Port).To(Equal(int32(80)))
+			Expect(svc.Spec.Ports[0].TargetPort.IntValue()).To(Equal(80))
+			Expect(metav1.IsControlledBy(svc, resource)).To(BeTrue())
+
+			By("Removing the service block from the App")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Service = nil
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &corev1.Service{}))).To(BeTrue())
+		})
+
+		It("should manage the Ingress from spec.ingress and report its URLs", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+
+			By("Adding service and ingress blocks to the App")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Service = &aloysv1.ServiceSpec{}
+			resource.Spec.Ingress = &aloysv1.IngressSpec{
+				IngressClassName: ptr.To("nginx"),
+				Hosts: []aloysv1.IngressHost{
+					{Host: "demo.example.com", Paths: []aloysv1.IngressPath{{Path: "/api"}}},
+				},
+				TLSSecretName: "demo-tls",
+			}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			ing := &networkingv1.Ingress{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, ing)).To(Succeed())
+			Expect(ing.Spec.IngressClassName).To(Equal(ptr.To("nginx")))
+			Expect(ing.Spec.Rules).To(HaveLen(1))
+			Expect(ing.Spec.Rules[0].Host).To(Equal("demo.example.com"))
+			path := ing.Spec.Rules[0].HTTP.Paths[0]
+			Expect(path.Path).To(Equal("/api"))
+			Expect(*path.PathType).To(Equal(networkingv1.PathTypePrefix))
+			Expect(path.Backend.Service.Name).To(Equal(resourceName))
+			Expect(path.Backend.Service.Port.Number).To(Equal(int32(80)))
+			Expect(ing.Spec.TLS).To(Equal([]networkingv1.IngressTLS{{Hosts: []string{"demo.example.com"}, SecretName: "demo-tls"}}))
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.URLs).To(Equal([]string{"https://demo.example.com/api"}))
+
+			By("Rejecting an ingress without a service")
+			resource.Spec.Service = nil
+			Expect(k8sClient.Update(ctx, resource)).NotTo(Succeed())
+
+			By("Removing the ingress block from the App")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Ingress = nil
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &networkingv1.Ingress{}))).To(BeTrue())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.URLs).To(BeEmpty())
+		})
+
+		It("should compute conditions, phase and observedGeneration from the Deployment", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Reporting a rollout in progress while the Deployment is not available")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.ObservedGeneration).To(Equal(resource.Generation))
+			Expect(resource.Status.Phase).To(Equal(aloysv1.AppPhasePending))
+			Expect(meta.IsStatusConditionFalse(resource.Status.Conditions, aloysv1.ConditionReady)).To(BeTrue())
+			Expect(meta.IsStatusConditionTrue(resource.Status.Conditions, aloysv1.ConditionProgressing)).To(BeTrue())
+			Expect(meta.IsStatusConditionFalse(resource.Status.Conditions, aloysv1.ConditionDegraded)).To(BeTrue())
+
+			By("Reporting Ready once the Deployment is rolled out")
+			// envtest 中没有 Deployment controller，手动写入 Deployment 的 status
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			deploy.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: deploy.Generation,
+				Replicas:           2,
+				UpdatedReplicas:    2,
+				ReadyReplicas:      2,
+				AvailableReplicas:  2,
+			}
+			Expect(k8sClient.Status().Update(ctx, deploy)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.Phase).To(Equal(aloysv1.AppPhaseRunning))
+			Expect(resource.Status.Replicas).To(Equal(int32(2)))
+			Expect(resource.Status.ReadyReplicas).To(Equal(int32(2)))
+			Expect(resource.Status.Selector).To(Equal("aloys.tech/app=" + resourceName))
+			Expect(meta.IsStatusConditionTrue(resource.Status.Conditions, aloysv1.ConditionReady)).To(BeTrue())
+			Expect(meta.IsStatusConditionFalse(resource.Status.Conditions, aloysv1.ConditionProgressing)).To(BeTrue())
+
+			By("Reporting Degraded when the Deployment exceeds its progress deadline")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			deploy.Status.Conditions = []appsv1.DeploymentCondition{{
+				Type:   appsv1.DeploymentProgressing,
+				Status: corev1.ConditionFalse,
+				Reason: "ProgressDeadlineExceeded",
+			}}
+			Expect(k8sClient.Status().Update(ctx, deploy)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.Phase).To(Equal(aloysv1.AppPhaseDegraded))
+			degraded := meta.FindStatusCondition(resource.Status.Conditions, aloysv1.ConditionDegraded)
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Status).To(Equal(metav1.ConditionTrue))
+			Expect(degraded.Reason).To(Equal("ProgressDeadlineExceeded"))
+		})
+
+		It("should propagate replicas set through the scale subresource", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Scaling the App like `kubectl scale` does")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			scale := &autoscalingv1.Scale{}
+			Expect(k8sClient.SubResource("scale").Get(ctx, resource, scale)).To(Succeed())
+			Expect(scale.Spec.Replicas).To(Equal(int32(2)))
+			Expect(scale.Status.Selector).To(Equal("aloys.tech/app=" + resourceName))
+
+			scale.Spec.Replicas = 5
+			Expect(k8sClient.SubResource("scale").Update(ctx, resource, client.WithSubResourceBody(scale))).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Replicas).To(Equal(ptr.To[int32](5)))
+		})
+
+		It("should manage a HorizontalPodAutoscaler without fighting it over replicas", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+
+			By("Enabling autoscaling on the App")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Autoscaling = &aloysv1.AutoscalingSpec{
+				MinReplicas:                    ptr.To[int32](2),
+				MaxReplicas:                    6,
+				TargetCPUUtilizationPercentage: ptr.To[int32](70),
+			}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, hpa)).To(Succeed())
+			Expect(hpa.Spec.ScaleTargetRef.Kind).To(Equal("Deployment"))
+			Expect(hpa.Spec.ScaleTargetRef.Name).To(Equal(resourceName))
+			Expect(hpa.Spec.MinReplicas).To(Equal(ptr.To[int32](2)))
+			Expect(hpa.Spec.MaxReplicas).To(Equal(int32(6)))
+			Expect(hpa.Spec.Metrics).To(HaveLen(1))
+			Expect(hpa.Spec.Metrics[0].Resource.Name).To(Equal(corev1.ResourceCPU))
+			Expect(hpa.Spec.Metrics[0].Resource.Target.AverageUtilization).To(Equal(ptr.To[int32](70)))
+
+			By("Keeping the replica count chosen by the HorizontalPodAutoscaler")
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			deploy.Spec.Replicas = ptr.To[int32](4)
+			Expect(k8sClient.Update(ctx, deploy)).To(Succeed())
+			hpa.Status = autoscalingv2.HorizontalPodAutoscalerStatus{CurrentReplicas: 3, DesiredReplicas: 4}
+			Expect(k8sClient.Status().Update(ctx, hpa)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Replicas).To(Equal(ptr.To[int32](4)))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.Autoscaling).To(Equal(&aloysv1.AutoscalingStatus{CurrentReplicas: 3, DesiredReplicas: 4}))
+
+			By("Disabling autoscaling on the App")
+			resource.Spec.Autoscaling = nil
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &autoscalingv2.HorizontalPodAutoscaler{}))).To(BeTrue())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Replicas).To(Equal(ptr.To[int32](2)))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.Autoscaling).To(BeNil())
+		})
+
+		It("should roll out the pods when a referenced ConfigMap or Secret changes", func() {
+			reader := &countingReader{Reader: k8sClient}
+			controllerReconciler := &AppReconciler{
+				Client:    k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				APIReader: reader,
+			}
+
+			By("Referencing a ConfigMap and a Secret from the App")
+			cm := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-config", Namespace: "default"},
+				Data:       map[string]string{"LOG_FORMAT": "json"},
+			}
+			Expect(k8sClient.Create(ctx, cm)).To(Succeed())
+			DeferCleanup(k8sClient.Delete, cm)
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName + "-secret", Namespace: "default"},
+				StringData: map[string]string{"password": "s3cr3t"},
+			}
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+			DeferCleanup(k8sClient.Delete, secret)
+
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.EnvFrom = []corev1.EnvFromSource{
+				{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: cm.Name}}},
+			}
+			resource.Spec.Volumes = []corev1.Volume{{
+				Name:         "secret",
+				VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secret.Name}},
+			}}
+			resource.Spec.VolumeMounts = []corev1.VolumeMount{{Name: "secret", MountPath: "/etc/secret"}}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			Expect(indexConfigRefs(resource)).To(Equal([]string{"ConfigMap/" + cm.Name, "Secret/" + secret.Name}))
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			firstHash := deploy.Spec.Template.Annotations["aloys.tech/config-hash"]
+			Expect(firstHash).NotTo(BeEmpty())
+			Expect(deploy.Spec.Template.Spec.Volumes).To(HaveLen(1))
+			Expect(deploy.Spec.Template.Spec.Containers[0].EnvFrom).To(HaveLen(1))
+			Expect(reader.gets).To(Equal(2))
+
+			By("Not reading the content again while the resource versions are unchanged")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reader.gets).To(Equal(2))
+
+			By("Changing the content of the ConfigMap")
+			cm.Data["LOG_FORMAT"] = "text"
+			Expect(k8sClient.Update(ctx, cm)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			secondHash := deploy.Spec.Template.Annotations["aloys.tech/config-hash"]
+			Expect(secondHash).NotTo(BeEmpty())
+			Expect(secondHash).NotTo(Equal(firstHash))
+			Expect(reader.gets).To(Equal(4))
+
+			By("Changing the content of the Secret")
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(secret), secret)).To(Succeed())
+			secret.Data["password"] = []byte("rotated")
+			Expect(k8sClient.Update(ctx, secret)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Annotations["aloys.tech/config-hash"]).NotTo(Equal(secondHash))
+		})
+
+		It("should run a canary rollout step by step and promote it", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			reconcileApp := func() ctrl.Result {
+				result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				return result
+			}
+			// envtest 中没有 Deployment controller，手动把 Deployment 标记为滚动完成
+			markRolledOut := func(key types.NamespacedName) {
+				deploy := &appsv1.Deployment{}
+				Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+				replicas := ptr.Deref(deploy.Spec.Replicas, 1)
+				deploy.Status = appsv1.DeploymentStatus{
+					ObservedGeneration: deploy.Generation,
+					Replicas:           replicas,
+					UpdatedReplicas:    replicas,
+					ReadyReplicas:      replicas,
+					AvailableReplicas:  replicas,
+				}
+				Expect(k8sClient.Status().Update(ctx, deploy)).To(Succeed())
+			}
+			canaryKey := types.NamespacedName{Name: resourceName + "-canary", Namespace: "default"}
+
+			By("Deploying the first version with the canary strategy")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Replicas = ptr.To[int32](4)
+			resource.Spec.Strategy = &aloysv1.AppStrategy{Canary: &aloysv1.CanaryStrategy{
+				Steps: []aloysv1.CanaryStep{
+					{Weight: 25, Pause: &metav1.Duration{Duration: time.Hour}},
+					{Weight: 50},
+				},
+			}}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			markRolledOut(typeNamespacedName)
+			reconcileApp()
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, canaryKey, &appsv1.Deployment{}))).To(BeTrue())
+
+			By("Changing the image starts the first step")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Image = "nginx:1.26"
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+
+			stable := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, stable)).To(Succeed())
+			Expect(stable.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.25"))
+			Expect(stable.Spec.Replicas).To(Equal(ptr.To[int32](3)))
+			canary := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, canaryKey, canary)).To(Succeed())
+			Expect(canary.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.26"))
+			Expect(canary.Spec.Replicas).To(Equal(ptr.To[int32](1)))
+			Expect(canary.Spec.Selector.MatchLabels).To(HaveKeyWithValue("aloys.tech/track", "canary"))
+			// stable 和 canary 的 selector 不重叠，stable Deployment 不会接管 canary 的 Pod
+			Expect(stable.Spec.Selector.MatchLabels).To(HaveKeyWithValue("aloys.tech/track", "stable"))
+			Expect(stable.Spec.Template.Labels).To(HaveKeyWithValue("aloys.tech/track", "stable"))
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.Canary).NotTo(BeNil())
+			Expect(resource.Status.Canary.CurrentStep).To(Equal(int32(0)))
+			Expect(resource.Status.Canary.Weight).To(Equal(int32(25)))
+			Expect(resource.Status.Phase).To(Equal(aloysv1.AppPhaseProgressing))
+
+			By("Pausing once the canary pods are available")
+			markRolledOut(canaryKey)
+			result := reconcileApp()
+			Expect(result.RequeueAfter).To(BeNumerically(">", 50*time.Minute))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.Canary.StepStartedAt).NotTo(BeNil())
+
+			By("Promoting manually through the annotation")
+			resource.Annotations = map[string]string{aloysv1.AnnotationCanaryPromote: "true"}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Annotations).NotTo(HaveKey(aloysv1.AnnotationCanaryPromote))
+			Expect(resource.Status.Canary.Promoted).To(BeTrue())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, stable)).To(Succeed())
+			Expect(stable.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.26"))
+			Expect(stable.Spec.Replicas).To(Equal(ptr.To[int32](4)))
+
+			By("Removing the canary once the stable Deployment is rolled out")
+			markRolledOut(typeNamespacedName)
+			reconcileApp()
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, canaryKey, &appsv1.Deployment{}))).To(BeTrue())
+
+			By("Aborting the next rollout")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Image = "nginx:1.27"
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, canaryKey, canary)).To(Succeed())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Annotations = map[string]string{aloysv1.AnnotationCanaryAbort: "true"}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, canaryKey, &appsv1.Deployment{}))).To(BeTrue())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, stable)).To(Succeed())
+			Expect(stable.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.26"))
+			Expect(stable.Spec.Replicas).To(Equal(ptr.To[int32](4)))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.Canary.Aborted).To(BeTrue())
+			progressing := meta.FindStatusCondition(resource.Status.Conditions, aloysv1.ConditionProgressing)
+			Expect(progressing).NotTo(BeNil())
+			Expect(progressing.Reason).To(Equal("CanaryAborted"))
+		})
+
+		It("should switch the Service between colors in blue/green mode", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			reconcileApp := func() ctrl.Result {
+				result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				return result
+			}
+			markRolledOut := func(name string) {
+				deploy := &appsv1.Deployment{}
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, deploy)).To(Succeed())
+				replicas := ptr.Deref(deploy.Spec.Replicas, 1)
+				deploy.Status = appsv1.DeploymentStatus{
+					ObservedGeneration: deploy.Generation,
+					Replicas:           replicas,
+					UpdatedReplicas:    replicas,
+					ReadyReplicas:      replicas,
+					AvailableReplicas:  replicas,
+				}
+				Expect(k8sClient.Status().Update(ctx, deploy)).To(Succeed())
+			}
+			serviceSelector := func(name string) map[string]string {
+				svc := &corev1.Service{}
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, svc)).To(Succeed())
+				return svc.Spec.Selector
+			}
+			blue, green := resourceName+"-blue", resourceName+"-green"
+
+			By("Enabling the blue/green strategy")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Service = &aloysv1.ServiceSpec{}
+			resource.Spec.Strategy = &aloysv1.AppStrategy{BlueGreen: &aloysv1.BlueGreenStrategy{
+				ScaleDownDelay: &metav1.Duration{Duration: time.Minute},
+			}}
+			resource.Spec.Autoscaling = &aloysv1.AutoscalingSpec{MaxReplicas: 4}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{}
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, hpa))).To(BeTrue())
+
+			By("Switching to blue once it is available")
+			markRolledOut(blue)
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, hpa)).To(Succeed())
+			Expect(hpa.Spec.ScaleTargetRef.Name).To(Equal(blue))
+			Expect(serviceSelector(resourceName)).To(HaveKeyWithValue("aloys.tech/color", "blue"))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.BlueGreen.ActiveColor).To(Equal("blue"))
+			Expect(resource.Status.BlueGreen.PreviewColor).To(BeEmpty())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &appsv1.Deployment{}))).To(BeTrue())
+
+			By("Rolling a new image out to green without switching the Service")
+			resource.Spec.Image = "nginx:1.26"
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: green, Namespace: "default"}, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.26"))
+			Expect(deploy.Spec.Template.Labels).To(HaveKeyWithValue("aloys.tech/color", "green"))
+			Expect(serviceSelector(resourceName)).To(HaveKeyWithValue("aloys.tech/color", "blue"))
+			Expect(serviceSelector(resourceName + "-preview")).To(HaveKeyWithValue("aloys.tech/color", "green"))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.BlueGreen.PreviewColor).To(Equal("green"))
+			Expect(resource.Status.Phase).To(Equal(aloysv1.AppPhaseProgressing))
+
+			By("Switching to green once it is available and keeping blue for the scale-down delay")
+			markRolledOut(green)
+			result := reconcileApp()
+			Expect(result.RequeueAfter).To(Equal(time.Minute))
+			Expect(serviceSelector(resourceName)).To(HaveKeyWithValue("aloys.tech/color", "green"))
+			Expect(serviceSelector(resourceName + "-preview")).To(HaveKeyWithValue("aloys.tech/color", "blue"))
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: blue, Namespace: "default"}, deploy)).To(Succeed())
+			Expect(deploy.Spec.Replicas).To(Equal(ptr.To[int32](2)))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.BlueGreen.ActiveColor).To(Equal("green"))
+			Expect(resource.Status.BlueGreen.PreviewColor).To(Equal("blue"))
+			Expect(resource.Status.BlueGreen.ScaleDownAt).NotTo(BeNil())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, hpa)).To(Succeed())
+			Expect(hpa.Spec.ScaleTargetRef.Name).To(Equal(green))
+
+			By("Scaling blue down once the delay expired")
+			resource.Status.BlueGreen.ScaleDownAt = &metav1.Time{Time: time.Now().Add(-time.Second)}
+			Expect(k8sClient.Status().Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: blue, Namespace: "default"}, deploy)).To(Succeed())
+			Expect(deploy.Spec.Replicas).To(Equal(ptr.To[int32](0)))
+		})
+
+		It("should record revisions and roll back to a previous one", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			reconcileApp := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			listRevisions := func() map[int64]string {
+				list := &appsv1.ControllerRevisionList{}
+				Expect(k8sClient.List(ctx, list, client.InNamespace("default"),
+					client.MatchingLabels{"aloys.tech/app": resourceName})).To(Succeed())
+				revisions := map[int64]string{}
+				for _, rev := range list.Items {
+					revisions[rev.Revision] = rev.Name
+				}
+				return revisions
+			}
+			resource := &aloysv1.App{}
+			updateApp := func(mutate func(*aloysv1.App)) {
+				Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+				mutate(resource)
+				Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			}
+
+			By("Recording a revision for each workload spec")
+			updateApp(func(app *aloysv1.App) { app.Spec.RevisionHistoryLimit = ptr.To[int32](1) })
+			reconcileApp()
+			for _, image := range []string{"nginx:1.26", "nginx:1.27"} {
+				updateApp(func(app *aloysv1.App) { app.Spec.Image = image })
+				reconcileApp()
+			}
+			// 只保留当前 revision 和 1 个旧 revision
+			Expect(listRevisions()).To(HaveLen(2))
+			Expect(listRevisions()).To(HaveKey(int64(3)))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.CurrentRevision).To(Equal(int64(3)))
+
+			By("Changing the replicas without recording a revision")
+			updateApp(func(app *aloysv1.App) { app.Spec.Replicas = ptr.To[int32](4) })
+			reconcileApp()
+			Expect(listRevisions()).To(HaveLen(2))
+
+			By("Rolling back to the previous revision")
+			updateApp(func(app *aloysv1.App) { app.Spec.RollbackTo = &aloysv1.RollbackConfig{} })
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Spec.RollbackTo).To(BeNil())
+			Expect(resource.Spec.Image).To(Equal("nginx:1.26"))
+			Expect(resource.Spec.Replicas).To(Equal(ptr.To[int32](4)))
+
+			reconcileApp()
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.26"))
+			// 回滚复用旧的 ControllerRevision，编号变为最新
+			Expect(listRevisions()).To(HaveLen(2))
+			Expect(listRevisions()).To(HaveKey(int64(4)))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.CurrentRevision).To(Equal(int64(4)))
+		})
+
+		It("should roll a crash looping revision back to the last healthy one", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			reconcileApp := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			deploy := &appsv1.Deployment{}
+			resource := &aloysv1.App{}
+
+			By("Recording the rolled out revision as healthy")
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			deploy.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: deploy.Generation,
+				Replicas:           2,
+				UpdatedReplicas:    2,
+				ReadyReplicas:      2,
+				AvailableReplicas:  2,
+			}
+			Expect(k8sClient.Status().Update(ctx, deploy)).To(Succeed())
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			healthy := resource.Status.LastHealthyRevision
+			Expect(healthy).NotTo(BeEmpty())
+
+			By("Rolling out an image whose pods crash")
+			resource.Spec.Image = "nginx:broken"
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName + "-broken",
+					Namespace: "default",
+					Labels:    map[string]string{"aloys.tech/app": resourceName, "aloys.tech/track": "stable"},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx:broken"}}},
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+				Name:  "app",
+				Image: "nginx:broken",
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+				LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+					ExitCode: 1,
+					Reason:   "Error",
+					Message:  "missing DATABASE_URL",
+				}},
+			}}
+			Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+
+			By("Rolling back to the last healthy revision")
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Spec.Image).To(Equal("nginx:1.25"))
+			Expect(resource.Status.LastRollback).NotTo(BeNil())
+			Expect(resource.Status.LastRollback.Revision).To(Equal(healthy))
+			Expect(resource.Status.LastRollback.Reason).To(Equal("CrashLoopBackOff"))
+
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.25"))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			degraded := meta.FindStatusCondition(resource.Status.Conditions, aloysv1.ConditionDegraded)
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Status).To(Equal(metav1.ConditionTrue))
+			Expect(degraded.Reason).To(Equal("CrashLoopBackOff"))
+			Expect(degraded.Message).To(ContainSubstring("missing DATABASE_URL"))
+		})
+
+		It("should not roll back on a transient pull error or once the rollout completed", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			reconcileApp := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			deploy := &appsv1.Deployment{}
+			resource := &aloysv1.App{}
+			markRolledOut := func() {
+				Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+				deploy.Status = appsv1.DeploymentStatus{
+					ObservedGeneration: deploy.Generation,
+					Replicas:           2,
+					UpdatedReplicas:    2,
+					ReadyReplicas:      2,
+					AvailableReplicas:  2,
+				}
+				Expect(k8sClient.Status().Update(ctx, deploy)).To(Succeed())
+			}
+
+			By("Recording the rolled out revision as healthy")
+			reconcileApp()
+			markRolledOut()
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.LastHealthyRevision).NotTo(BeEmpty())
+
+			By("Rolling out a new image whose first pull fails")
+			resource.Spec.Image = "nginx:1.26"
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName + "-pulling",
+					Namespace: "default",
+					Labels:    map[string]string{"aloys.tech/app": resourceName, "aloys.tech/track": "stable"},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "nginx:1.26"}}},
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			setWaiting := func(reason string) {
+				pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+					Name:  "app",
+					Image: "nginx:1.26",
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason}},
+				}}
+				Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+			}
+			setWaiting("ErrImagePull")
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Spec.Image).To(Equal("nginx:1.26"))
+			Expect(resource.Status.LastRollback).To(BeNil())
+
+			By("Keeping the spec when the pods crash after the rollout completed")
+			markRolledOut()
+			setWaiting("CrashLoopBackOff")
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Spec.Image).To(Equal("nginx:1.26"))
+			Expect(resource.Status.LastRollback).To(BeNil())
+			Expect(meta.IsStatusConditionTrue(resource.Status.Conditions, aloysv1.ConditionDegraded)).To(BeTrue())
+		})
+
+		It("should not touch the children while the App is paused", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			reconcileApp := func() {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			reconcileApp()
+
+			By("Pausing the App and hotfixing the Deployment by hand")
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Annotations = map[string]string{aloysv1.AnnotationPaused: "true"}
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			deploy.Spec.Template.Spec.Containers[0].Image = "nginx:hotfix"
+			Expect(k8sClient.Update(ctx, deploy)).To(Succeed())
+
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:hotfix"))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			paused := meta.FindStatusCondition(resource.Status.Conditions, aloysv1.ConditionPaused)
+			Expect(paused).NotTo(BeNil())
+			Expect(paused.Status).To(Equal(metav1.ConditionTrue))
+
+			By("Keeping the App paused through spec.paused")
+			resource.Annotations = nil
+			resource.Spec.Paused = true
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:hotfix"))
+
+			By("Reverting the hotfix once resumed")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			resource.Spec.Paused = false
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			reconcileApp()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.25"))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(meta.FindStatusCondition(resource.Status.Conditions, aloysv1.ConditionPaused)).To(BeNil())
+		})
+
+		It("should apply the deletion policy to the children", func() {
+			controllerReconciler := &AppReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			owner := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, owner)).To(Succeed())
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName + "-data",
+					Namespace: "default",
+					Labels:    map[string]string{"aloys.tech/app": resourceName},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+					},
+				},
+			}
+			Expect(ctrl.SetControllerReference(owner, pvc, k8sClient.Scheme())).To(Succeed())
+			Expect(k8sClient.Create(ctx, pvc)).To(Succeed())
+
+			By("Keeping the PersistentVolumeClaim with the Retain policy")
+			owner.Spec.DeletionPolicy = aloysv1.DeletionPolicyRetain
+			owner.Spec.RetainKinds = []string{"PersistentVolumeClaim"}
+			Expect(k8sClient.Update(ctx, owner)).To(Succeed())
+			done, err := controllerReconciler.finalize(ctx, owner)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeTrue())
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(pvc), pvc)).To(Succeed())
+			Expect(pvc.OwnerReferences).To(BeEmpty())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, typeNamespacedName, &appsv1.Deployment{}))).To(BeTrue())
+
+			By("Orphaning every child with the Orphan policy")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, owner)).To(Succeed())
+			owner.Spec.DeletionPolicy = aloysv1.DeletionPolicyOrphan
+			Expect(k8sClient.Update(ctx, owner)).To(Succeed())
+			done, err = controllerReconciler.finalize(ctx, owner)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeTrue())
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deploy)).To(Succeed())
+			Expect(deploy.OwnerReferences).To(BeEmpty())
+		})
+
+		It("should manage external resources through the registered providers", func() {
+			provider := external.NewMemoryProvider("memory")
+			controllerReconciler := &AppReconciler{
+				Client:    k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Providers: external.NewRegistry(provider),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.ExternalResources).To(HaveLen(1))
+			Expect(resource.Status.ExternalResources[0].Provider).To(Equal("memory"))
+			Expect(resource.Status.ExternalResources[0].Ready).To(BeTrue())
+			id := resource.Status.ExternalResources[0].ID
+			Expect(id).NotTo(BeEmpty())
+
+			By("Keeping the ID on update")
+			resource.Spec.Image = "nginx:1.26"
+			Expect(k8sClient.Update(ctx, resource)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.ExternalResources[0].ID).To(Equal(id))
+			Expect(provider.Len()).To(Equal(1))
+
+			By("Deleting the external resource when the App is finalized")
+			done, err := controllerReconciler.finalize(ctx, resource)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(done).To(BeTrue())
+			Expect(provider.Len()).To(BeZero())
+		})
+
+		It("should keep the ID of an external resource when observing it fails", func() {
+			provider := &unobservableProvider{MemoryProvider: external.NewMemoryProvider("memory"), failures: 1}
+			controllerReconciler := &AppReconciler{
+				Client:    k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Providers: external.NewRegistry(provider),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(MatchError(ContainSubstring("provider unavailable")))
+
+			resource := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.ExternalResources).To(HaveLen(1))
+			id := resource.Status.ExternalResources[0].ID
+			Expect(id).NotTo(BeEmpty())
+
+			By("Reusing the same resource on the next reconcile")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.ExternalResources).To(HaveLen(1))
+			Expect(resource.Status.ExternalResources[0].ID).To(Equal(id))
+			Expect(resource.Status.ExternalResources[0].Ready).To(BeTrue())
+			Expect(provider.Len()).To(Equal(1))
+
+			By("Keeping the resources of the providers that are no longer registered")
+			controllerReconciler.Providers = external.NewRegistry()
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, resource)).To(Succeed())
+			Expect(resource.Status.ExternalResources).To(HaveLen(1))
+			Expect(resource.Status.ExternalResources[0].ID).To(Equal(id))
+		})
+	})
+
+	Context("When the cleanup of a deleted App fails", func() {
+		const resourceName = "cleanup-fails"
+		ctx := context.Background()
+		key := types.NamespacedName{Name: resourceName, Namespace: "default"}
+
+		It("should record the attempts and release the App when force-finalized", func() {
+			Expect(k8sClient.Create(ctx, &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			})).To(Succeed())
+			recorder := record.NewFakeRecorder(100)
+			controllerReconciler := &AppReconciler{
+				Client:    k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Providers: external.NewRegistry(&failingProvider{MemoryProvider: external.NewMemoryProvider("failing")}),
+				Recorder:  recorder,
+				// 第一次清理失败时就已经超时，立即设置 CleanupStalled
+				CleanupTimeout: time.Nanosecond,
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Recording the failed cleanup attempt")
+			app := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).To(MatchError(ContainSubstring("provider unavailable")))
+
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Status.Phase).To(Equal(aloysv1.AppPhaseTerminating))
+			Expect(app.Status.Cleanup).NotTo(BeNil())
+			Expect(app.Status.Cleanup.Attempts).To(Equal(int32(1)))
+			Expect(app.Status.Cleanup.LastError).To(ContainSubstring("provider unavailable"))
+			Expect(meta.IsStatusConditionTrue(app.Status.Conditions, aloysv1.ConditionCleanupStalled)).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElements(ContainSubstring("CleanupFailed"), ContainSubstring("CleanupStalled")))
+
+			By("Waiting for the backoff before the next attempt")
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(BeNumerically(">", 0))
+
+			By("Releasing the App with the force-finalize annotation")
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			app.Annotations = map[string]string{aloysv1.AnnotationForceFinalize: "provider outage"}
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, key, &aloysv1.App{}))).To(BeTrue())
+			Expect(recordedEvents(recorder)).To(ContainElement(And(ContainSubstring("ForceFinalized"), ContainSubstring("provider outage"))))
+		})
+
+		It("should not count waiting for the children as an attempt", func() {
+			waitKey := types.NamespacedName{Name: resourceName + "-waits", Namespace: "default"}
+			app := &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: waitKey.Name, Namespace: "default", Finalizers: []string{appFinalizer}},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(k8sClient.Get(ctx, waitKey, app)).To(Succeed())
+				app.Finalizers = nil
+				Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			})
+			controllerReconciler := &AppReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+
+			Expect(k8sClient.Get(ctx, waitKey, app)).To(Succeed())
+			Expect(controllerReconciler.updateCleanupStatus(ctx, app, nil)).To(Succeed())
+			Expect(k8sClient.Get(ctx, waitKey, app)).To(Succeed())
+			Expect(app.Status.Phase).To(Equal(aloysv1.AppPhaseTerminating))
+			Expect(app.Status.Cleanup).NotTo(BeNil())
+			Expect(app.Status.Cleanup.Attempts).To(BeZero())
+			Expect(app.Status.Cleanup.LastAttemptTime).To(BeNil())
+
+			By("Skipping the status patch when nothing changed")
+			resourceVersion := app.ResourceVersion
+			Expect(controllerReconciler.updateCleanupStatus(ctx, app, nil)).To(Succeed())
+			Expect(k8sClient.Get(ctx, waitKey, app)).To(Succeed())
+			Expect(app.ResourceVersion).To(Equal(resourceVersion))
+			Expect(cleanupRetryDelay(app.Status.Cleanup)).To(Equal(finalizeRequeueDelay))
+		})
+	})
+
+	Context("When applying child resources", func() {
+		const resourceName = "server-side-apply"
+		ctx := context.Background()
+		key := types.NamespacedName{Name: resourceName, Namespace: "default"}
+
+		AfterEach(func() {
+			app := &aloysv1.App{}
+			if err := k8sClient.Get(ctx, key, app); err == nil {
+				app.Finalizers = nil
+				Expect(k8sClient.Update(ctx, app)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			}
+			_ = k8sClient.Delete(ctx, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"}})
+		})
+
+		It("should only own the fields it sets and skip unchanged objects", func() {
+			Expect(k8sClient.Create(ctx, &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			})).To(Succeed())
+			controllerReconciler := &AppReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			managers := []string{}
+			for _, entry := range deploy.ManagedFields {
+				if entry.Operation == metav1.ManagedFieldsOperationApply {
+					managers = append(managers, entry.Manager)
+				}
+			}
+			Expect(managers).To(ConsistOf(fieldManager))
+
+			By("Keeping the fields set by another field manager")
+			deploy.Labels["example.com/mesh"] = "enabled"
+			Expect(k8sClient.Update(ctx, deploy, client.FieldOwner("service-mesh"))).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			Expect(deploy.Labels).To(HaveKeyWithValue("example.com/mesh", "enabled"))
+
+			By("Not writing the Deployment when nothing changed")
+			resourceVersion := deploy.ResourceVersion
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			Expect(deploy.ResourceVersion).To(Equal(resourceVersion))
+		})
+	})
+
+	Context("When a child resource is changed outside of the App", func() {
+		const resourceName = "drift"
+		ctx := context.Background()
+		key := types.NamespacedName{Name: resourceName, Namespace: "default"}
+		imagePath := "spec.template.spec.containers[name=app].image"
+
+		AfterEach(func() {
+			app := &aloysv1.App{}
+			if err := k8sClient.Get(ctx, key, app); err == nil {
+				app.Finalizers = nil
+				Expect(k8sClient.Update(ctx, app)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			}
+			_ = k8sClient.Delete(ctx, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"}})
+		})
+
+		// kubectlEdit changes the image of the Deployment the way `kubectl edit` does.
+		kubectlEdit := func(image string) {
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			deploy.Spec.Template.Spec.Containers[0].Image = image
+			Expect(k8sClient.Update(ctx, deploy, client.FieldOwner("kubectl-edit"))).To(Succeed())
+		}
+
+		It("should record the drift and correct or report it according to the drift policy", func() {
+			Expect(k8sClient.Create(ctx, &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			})).To(Succeed())
+			recorder := record.NewFakeRecorder(100)
+			controllerReconciler := &AppReconciler{Client: k8sClient, Scheme: k8sClient.Scheme(), Recorder: recorder}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Reverting the change under the Correct drift policy")
+			kubectlEdit("nginx:hotfix")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.25"))
+			app := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Status.Drift).To(HaveLen(1))
+			Expect(app.Status.Drift[0].Kind).To(Equal("Deployment"))
+			Expect(app.Status.Drift[0].Corrected).To(BeTrue())
+			Expect(app.Status.Drift[0].Fields).To(ConsistOf(aloysv1.FieldDrift{Path: imagePath, Desired: "nginx:1.25", Live: "nginx:hotfix"}))
+			Expect(recordedEvents(recorder)).To(ContainElement(ContainSubstring(eventDriftDetected)))
+
+			By("Leaving the change in place under the Report drift policy")
+			app.Spec.DriftPolicy = aloysv1.DriftPolicyReport
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			kubectlEdit("nginx:hotfix")
+			for i := 0; i < 2; i++ {
+				_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:hotfix"))
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Status.Drift).To(HaveLen(1))
+			Expect(app.Status.Drift[0].Corrected).To(BeFalse())
+			// 同一个 drift 只记录一次 Event
+			Expect(recordedEvents(recorder)).To(ConsistOf(ContainSubstring(eventDriftDetected)))
+
+			By("Resolving the reported drift when the App changes")
+			app.Spec.Image = "nginx:1.26"
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.26"))
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Status.Drift).To(BeEmpty())
+		})
+	})
+
+	Context("When the operator configuration sets the defaults and the feature gates", func() {
+		const resourceName = "configured"
+		ctx := context.Background()
+		key := types.NamespacedName{Name: resourceName, Namespace: "default"}
+
+		AfterEach(func() {
+			app := &aloysv1.App{}
+			if err := k8sClient.Get(ctx, key, app); err == nil {
+				app.Finalizers = nil
+				Expect(k8sClient.Update(ctx, app)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			}
+			_ = k8sClient.Delete(ctx, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"}})
+		})
+
+		// loadConfig parses a configuration file the way the Reloader does.
+		loadConfig := func(content string) *config.Store {
+			cfg, err := config.Parse([]byte("apiVersion: config.aloys.tech/v1alpha1\nkind: OperatorConfig\n" + content))
+			Expect(err).NotTo(HaveOccurred())
+			return config.NewStore(cfg)
+		}
+
+		// kubectlEdit changes the image of the Deployment the way `kubectl edit` does.
+		kubectlEdit := func(image string) {
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			deploy.Spec.Template.Spec.Containers[0].Image = image
+			Expect(k8sClient.Update(ctx, deploy, client.FieldOwner("kubectl-edit"))).To(Succeed())
+		}
+
+		It("should use the configured drift policy and stop detecting drift once the gate is disabled", func() {
+			Expect(k8sClient.Create(ctx, &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			})).To(Succeed())
+			controllerReconciler := &AppReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: record.NewFakeRecorder(100),
+				Config:   loadConfig("defaults:\n  driftPolicy: Report\n"),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Reporting the drift of an App without spec.driftPolicy")
+			kubectlEdit("nginx:hotfix")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:hotfix"))
+			app := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Spec.DriftPolicy).To(BeEmpty())
+			Expect(app.Status.Drift).To(HaveLen(1))
+			Expect(app.Status.Drift[0].Corrected).To(BeFalse())
+
+			By("Applying the App spec without comparing once DriftDetection is disabled")
+			controllerReconciler.Config = loadConfig("featureGates:\n  DriftDetection: false\ndefaults:\n  driftPolicy: Report\n")
+			app.Spec.Image = "nginx:1.26"
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			kubectlEdit("nginx:hotfix")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			Expect(deploy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.26"))
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Status.Drift).To(BeEmpty())
+		})
+	})
+
+	Context("When an App keeps failing to reconcile", func() {
+		const resourceName = "keeps-failing"
+		ctx := context.Background()
+		key := types.NamespacedName{Name: resourceName, Namespace: "default"}
+
+		AfterEach(func() {
+			app := &aloysv1.App{}
+			if err := k8sClient.Get(ctx, key, app); err == nil {
+				app.Finalizers = nil
+				Expect(k8sClient.Update(ctx, app)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			}
+		})
+
+		It("should record the failure once instead of on every reconcile", func() {
+			Expect(k8sClient.Create(ctx, &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			})).To(Succeed())
+			recorder := record.NewFakeRecorder(100)
+			controllerReconciler := &AppReconciler{
+				Client:    k8sClient,
+				Scheme:    k8sClient.Scheme(),
+				Providers: external.NewRegistry(&unreachableProvider{MemoryProvider: external.NewMemoryProvider("unreachable")}),
+				Recorder:  recorder,
+			}
+			for i := 0; i < 3; i++ {
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+				Expect(err).To(MatchError(ContainSubstring("provider unreachable")))
+			}
+
+			events := recordedEvents(recorder)
+			Expect(events).To(ContainElement(ContainSubstring(eventFinalizerAdded)))
+			var failures []string
+			for _, event := range events {
+				if strings.Contains(event, eventReconcileFailed) {
+					failures = append(failures, event)
+				}
+			}
+			Expect(failures).To(ConsistOf(And(HavePrefix(corev1.EventTypeWarning), ContainSubstring("provider unreachable"))))
+		})
+	})
+
+	Context("When exporting metrics", func() {
+		const resourceName = "metrics"
+		ctx := context.Background()
+		key := types.NamespacedName{Name: resourceName, Namespace: "default"}
+
+		AfterEach(func() {
+			app := &aloysv1.App{}
+			if err := k8sClient.Get(ctx, key, app); err == nil {
+				app.Finalizers = nil
+				Expect(k8sClient.Update(ctx, app)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			}
+			_ = k8sClient.Delete(ctx, &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"}})
+		})
+
+		It("should report the state of the App and the reconcile phases", func() {
+			Expect(k8sClient.Create(ctx, &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec: aloysv1.AppSpec{
+					Image:    "nginx:1.25",
+					Replicas: ptr.To(int32(3)),
+					// Orphan 策略下删除 App 时不需要等待子资源被垃圾回收
+					DeletionPolicy: aloysv1.DeletionPolicyOrphan,
+				},
+			})).To(Succeed())
+			rolloutsStarted := testutil.ToFloat64(rolloutTotal.WithLabelValues(rolloutStarted))
+			controllerReconciler := &AppReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(testutil.ToFloat64(appReady.WithLabelValues("default", resourceName))).To(Equal(0.0))
+			Expect(testutil.ToFloat64(appReplicasDesired.WithLabelValues("default", resourceName))).To(Equal(3.0))
+			Expect(testutil.ToFloat64(appReplicasAvailable.WithLabelValues("default", resourceName))).To(Equal(0.0))
+			Expect(testutil.ToFloat64(rolloutTotal.WithLabelValues(rolloutStarted))).To(Equal(rolloutsStarted + 1))
+			Expect(testutil.CollectAndCount(reconcilePhaseDuration)).To(BeNumerically(">=", 8))
+
+			By("Reporting the App as ready once its pods are available")
+			deploy := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			deploy.Status = appsv1.DeploymentStatus{
+				ObservedGeneration: deploy.Generation,
+				Replicas:           3,
+				UpdatedReplicas:    3,
+				ReadyReplicas:      3,
+				AvailableReplicas:  3,
+			}
+			Expect(k8sClient.Status().Update(ctx, deploy)).To(Succeed())
+			rolloutsSucceeded := testutil.ToFloat64(rolloutTotal.WithLabelValues(rolloutSucceeded))
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testutil.ToFloat64(appReady.WithLabelValues("default", resourceName))).To(Equal(1.0))
+			Expect(testutil.ToFloat64(appReplicasAvailable.WithLabelValues("default", resourceName))).To(Equal(3.0))
+			Expect(testutil.ToFloat64(rolloutTotal.WithLabelValues(rolloutSucceeded))).To(Equal(rolloutsSucceeded + 1))
+
+			By("Refreshing the gauges while the App is paused")
+			app := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			app.Annotations = map[string]string{aloysv1.AnnotationPaused: "true"}
+			Expect(k8sClient.Update(ctx, app)).To(Succeed())
+			Expect(k8sClient.Get(ctx, key, deploy)).To(Succeed())
+			deploy.Status.ReadyReplicas, deploy.Status.AvailableReplicas = 1, 1
+			Expect(k8sClient.Status().Update(ctx, deploy)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testutil.ToFloat64(appReady.WithLabelValues("default", resourceName))).To(Equal(0.0))
+			Expect(testutil.ToFloat64(appReplicasAvailable.WithLabelValues("default", resourceName))).To(Equal(1.0))
+
+			By("Forgetting the App once it is deleted")
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			for i := 0; i < 2; i++ {
+				_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, key, &aloysv1.App{}))).To(BeTrue())
+			Expect(appReady.DeleteLabelValues("default", resourceName)).To(BeFalse())
+			Expect(testutil.CollectAndCount(finalizerCleanupDuration)).To(BeNumerically(">=", 1))
+		})
+	})
+
+	Context("When tracing the reconcile", func() {
+		const resourceName = "tracing"
+		ctx := context.Background()
+		key := types.NamespacedName{Name: resourceName, Namespace: "default"}
+
+		AfterEach(func() {
+			otel.SetTracerProvider(tracenoop.NewTracerProvider())
+			app := &aloysv1.App{}
+			if err := k8sClient.Get(ctx, key, app); err == nil {
+				app.Finalizers = nil
+				Expect(k8sClient.Update(ctx, app)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			}
+		})
+
+		It("should record a span for the reconcile, its phases and its API calls", func() {
+			Expect(k8sClient.Create(ctx, &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			})).To(Succeed())
+			recorder := tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+			controllerReconciler := &AppReconciler{Client: tracing.WrapClient(k8sClient), Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			spans := map[string]sdktrace.ReadOnlySpan{}
+			for _, s := range recorder.Ended() {
+				spans[s.Name()] = s
+			}
+			Expect(spans).To(HaveKey("Reconcile"))
+			reconcileSpan := spans["Reconcile"].SpanContext()
+			for _, phase := range []string{phaseRevision, phaseWorkload, phaseService, phaseStatus} {
+				Expect(spans).To(HaveKey(phase))
+				Expect(spans[phase].Parent().SpanID()).To(Equal(reconcileSpan.SpanID()))
+			}
+			Expect(spans).To(HaveKey("Apply Deployment"))
+			Expect(spans["Apply Deployment"].Parent().SpanID()).To(Equal(spans[phaseWorkload].SpanContext().SpanID()))
+			Expect(spans).To(HaveKey("Patch App/status"))
+		})
+	})
+
+	Context("When the App is modified concurrently", func() {
+		const resourceName = "concurrent-writes"
+		ctx := context.Background()
+		key := types.NamespacedName{Name: resourceName, Namespace: "default"}
+
+		AfterEach(func() {
+			app := &aloysv1.App{}
+			if err := k8sClient.Get(ctx, key, app); err == nil {
+				app.Finalizers = nil
+				Expect(k8sClient.Update(ctx, app)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+			}
+		})
+
+		It("should patch a stale copy without overwriting the concurrent change", func() {
+			Expect(k8sClient.Create(ctx, &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			})).To(Succeed())
+			controllerReconciler := &AppReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+
+			stale := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, key, stale)).To(Succeed())
+			// 模拟另一个 worker 或用户在读取之后修改了 App
+			concurrent := stale.DeepCopy()
+			concurrent.Annotations = map[string]string{"example.com/owner": "team-a"}
+			Expect(k8sClient.Update(ctx, concurrent)).To(Succeed())
+
+			By("Retrying the finalizer patch on the latest version")
+			Expect(controllerReconciler.patchApp(ctx, stale.DeepCopy(), func(app *aloysv1.App) {
+				app.Finalizers = append(app.Finalizers, appFinalizer)
+			})).To(Succeed())
+			app := &aloysv1.App{}
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Finalizers).To(ConsistOf(appFinalizer))
+			Expect(app.Annotations).To(HaveKeyWithValue("example.com/owner", "team-a"))
+
+			By("Patching the status regardless of the resourceVersion")
+			status := stale.Status.DeepCopy()
+			status.Phase = aloysv1.AppPhasePending
+			Expect(controllerReconciler.patchStatus(ctx, stale.DeepCopy(), status)).To(Succeed())
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Status.Phase).To(Equal(aloysv1.AppPhasePending))
+
+			By("Refusing a spec change computed from the stale copy")
+			changed := stale.DeepCopy()
+			changed.Spec.Image = "nginx:1.24"
+			err := controllerReconciler.patchAppSpec(ctx, stale, changed)
+			Expect(errors.IsConflict(err)).To(BeTrue())
+			Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+			Expect(app.Spec.Image).To(Equal("nginx:1.25"))
+		})
+	})
+
+	Context("When migrating the legacy finalizer", func() {
+		const legacyFinalizer = "storage.finalizers.tutorial.kubebuilder.io"
+		ctx := context.Background()
+
+		// 预先创建只带有旧 finalizer 的 App，模拟旧版本 controller 创建的对象
+		seedApp := func(name string, finalizers ...string) types.NamespacedName {
+			app := &aloysv1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Finalizers: finalizers},
+				Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+			}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+			return client.ObjectKeyFromObject(app)
+		}
+		reconcileApp := func(key types.NamespacedName) {
+			controllerReconciler := &AppReconciler{Client: k8sClient, Scheme: k8sClient.Scheme()}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		// 删除后持续 Reconcile，直到 finalizer 被移除、App 被释放
+		expectReleased := func(key types.NamespacedName) {
+			Eventually(func() bool {
+				reconcileApp(key)
+				return errors.IsNotFound(k8sClient.Get(ctx, key, &aloysv1.App{}))
+			}).Should(BeTrue())
+		}
+
+		It("should replace the legacy finalizer in a single update", func() {
+			keys := []types.NamespacedName{
+				seedApp("legacy-finalizer", legacyFinalizer),
+				seedApp("legacy-and-new-finalizer", legacyFinalizer, "aloys.tech/finalizer"),
+				seedApp("legacy-and-foreign-finalizer", "example.com/keep", legacyFinalizer),
+			}
+			for _, key := range keys {
+				reconcileApp(key)
+
+				app := &aloysv1.App{}
+				Expect(k8sClient.Get(ctx, key, app)).To(Succeed())
+				Expect(app.Finalizers).To(ContainElement("aloys.tech/finalizer"))
+				Expect(app.Finalizers).NotTo(ContainElement(legacyFinalizer))
+				if key.Name == "legacy-and-foreign-finalizer" {
+					Expect(app.Finalizers).To(ContainElement("example.com/keep"))
+					app.Finalizers = []string{"aloys.tech/finalizer"}
+					Expect(k8sClient.Update(ctx, app)).To(Succeed())
+				}
+
+				Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+				expectReleased(key)
+			}
+		})
+
+		It("should clean up an App deleted before its finalizer was migrated", func() {
+			key := seedApp("legacy-finalizer-deleted", legacyFinalizer)
+			Expect(k8sClient.Delete(ctx, &aloysv1.App{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}})).To(Succeed())
+			expectReleased(key)
 		})
 	})
 })
+
+// recordedEvents drains the Events recorded so far.
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// unreachableProvider is a memory provider whose resources cannot be created.
+type unreachableProvider struct {
+	*external.MemoryProvider
+}
+
+func (p *unreachableProvider) Ensure(context.Context, *aloysv1.App, string) (string, error) {
+	return "", fmt.Errorf("provider unreachable")
+}
+
+// failingProvider is a memory provider whose resources cannot be deleted.
+type failingProvider struct {
+	*external.MemoryProvider
+}
+
+func (p *failingProvider) Delete(context.Context, *aloysv1.App, string) error {
+	return fmt.Errorf("provider unavailable")
+}
+
+// unobservableProvider is a memory provider whose resources cannot be observed the first failures times.
+type unobservableProvider struct {
+	*external.MemoryProvider
+	failures int
+}
+
+func (p *unobservableProvider) Observe(ctx context.Context, app *aloysv1.App, id string) (external.Observation, error) {
+	if p.failures > 0 {
+		p.failures--
+		return external.Observation{}, fmt.Errorf("provider unavailable")
+	}
+	return p.MemoryProvider.Observe(ctx, app, id)
+}
+
+// countingReader counts the Get calls sent to the apiserver.
+type countingReader struct {
+	client.Reader
+	gets int
+}
+
+func (r *countingReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	r.gets++
+	return r.Reader.Get(ctx, key, obj, opts...)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+	"kubebuilder-demo1/internal/config"
+)
+
+// fieldManager is the field manager the controller applies the child resources of the Apps with.
+// 其他组件(HPA、service mesh 或者用户)修改的字段属于它们自己的 field manager，controller 不会覆盖
+const fieldManager = "app-operator"
+
+// appliedHashAnnotation 记录 controller 最近一次提交的内容的 hash，用来区分 App 的变化和在 App 之外对子资源的修改
+const appliedHashAnnotation = "aloys.tech/applied-hash"
+
+// getOwned reads the live object with the given key into obj and extracts the fields the controller
+// applied from it with extract, e.g. appsv1ac.ExtractDeployment. It returns nil when the object does
+// not exist, or when its managed fields cannot be extracted, so that the object is applied again.
+func getOwned[T client.Object, AC any](ctx context.Context, c client.Client, key types.NamespacedName, obj T,
+	extract func(T, string) (*AC, error)) (*AC, error) {
+	if err := c.Get(ctx, key, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	owned, err := extract(obj, fieldManager)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "unable to extract the applied fields, applying again", "name", key.Name)
+		return nil, nil
+	}
+	return owned, nil
+}
+
+// applyObject submits desired, an apply configuration, with server-side apply under fieldManager and
+// decodes the resulting object into obj. Nothing is sent when owned, the fields the controller applied
+// to the live object, already matches desired: obj then keeps holding the live object.
+// 只比较 controller 自己负责的字段，apiserver 填充的默认值和其他 field manager 的修改都不会触发更新
+//
+// desired is applied together with a hash of its content. When the hash of the live object matches,
+// the App did not change since the last apply, so a difference in the fields the controller owns was
+// made outside of the App: it is recorded as a drift and only reverted under the Correct drift policy.
+// The comparison is skipped when the DriftDetection feature gate is disabled.
+func (r *AppReconciler) applyObject(ctx context.Context, app *aloysv1.App, children *appChildren, obj client.Object, desired, owned any) (bool, error) {
+	u := &unstructured.Unstructured{}
+	if err := convertJSON(desired, &u.Object); err != nil {
+		return false, err
+	}
+	unstructured.RemoveNestedField(u.Object, "metadata", "annotations", appliedHashAnnotation)
+	data, err := json.Marshal(u.Object)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])[:10]
+	if err := unstructured.SetNestedField(u.Object, hash, "metadata", "annotations", appliedHashAnnotation); err != nil {
+		return false, err
+	}
+
+	var ownedFields map[string]interface{}
+	if err := convertJSON(owned, &ownedFields); err != nil {
+		return false, err
+	}
+	if equality.Semantic.DeepEqual(u.Object, ownedFields) {
+		return false, nil
+	}
+	// 关闭 DriftDetection 时不比较线上的字段，直接按照 App 的 spec 重新提交
+	if r.Config.FeatureEnabled(config.FeatureDriftDetection) && obj.GetAnnotations()[appliedHashAnnotation] == hash {
+		var live map[string]interface{}
+		if err := convertJSON(obj, &live); err != nil {
+			return false, err
+		}
+		if fields := diffFields(u.Object, live); len(fields) > 0 {
+			r.recordDrift(ctx, app, children, u.GetKind(), u.GetName(), fields)
+			if r.driftPolicy(app) == aloysv1.DriftPolicyReport {
+				return false, nil
+			}
+		}
+	}
+
+	// ForceOwnership：和其他 field manager 冲突的字段以 App 的 spec 为准
+	exists := obj.GetResourceVersion() != ""
+	if err := r.Patch(ctx, u, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership); err != nil {
+		return false, fmt.Errorf("unable to apply %s %s: %w", u.GetKind(), u.GetName(), err)
+	}
+	if exists {
+		r.eventf(app, corev1.EventTypeNormal, eventUpdated, "Updated %s %s", u.GetKind(), u.GetName())
+	} else {
+		r.eventf(app, corev1.EventTypeNormal, eventCreated, "Created %s %s", u.GetKind(), u.GetName())
+	}
+	return true, runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, obj)
+}
+
+// toApplyConfiguration converts obj into the apply configuration ac. obj must be built from scratch
+// with only the fields the controller manages: empty fields are left out of the apply configuration,
+// except the ones serialized with their zero value, like the status, which the caller has to clear.
+// 子资源仍然由 mutate 函数生成，pod 模板的 hash 和之前保持一致
+func toApplyConfiguration(obj runtime.Object, ac any) error {
+	return convertJSON(obj, ac)
+}
+
+// convertJSON converts in into out through their JSON representation.
+// 转换成 map 时数字统一为 float64，提交的内容、controller 负责的字段和现有对象可以直接比较
+func convertJSON(in, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+const (
+	// colorLabelKey 区分 blue/green 两套 Pod，Service 通过它切换流量
+	colorLabelKey = "aloys.tech/color"
+	colorBlue     = "blue"
+	colorGreen    = "green"
+
+	defaultScaleDownDelay = 30 * time.Second
+)
+
+// isBlueGreen reports whether the App is rolled out with the blue/green strategy.
+func isBlueGreen(app *aloysv1.App) bool {
+	return app.Spec.Strategy != nil && app.Spec.Strategy.BlueGreen != nil
+}
+
+// colorName returns the name of the Deployment of a color.
+func colorName(app *aloysv1.App, color string) string {
+	return app.Name + "-" + color
+}
+
+// previewName returns the name of the preview Service of the App.
+func previewName(app *aloysv1.App) string {
+	return app.Name + "-preview"
+}
+
+func otherColor(color string) string {
+	if color == colorBlue {
+		return colorGreen
+	}
+	return colorBlue
+}
+
+// colorSelector returns the labels selecting the pods of a color.
+func colorSelector(app *aloysv1.App, color string) map[string]string {
+	labels := selectorLabels(app)
+	labels[colorLabelKey] = color
+	return labels
+}
+
+// reconcileBlueGreen runs a blue/green rollout: a new pod template is rolled out to the preview color,
+// and the colors are switched once it is fully available. The previous color is scaled down after
+// spec.strategy.blueGreen.scaleDownDelay.
+// 两种颜色的状态记录在 children.blueGreenStatus 中，由 updateStatus 写回 status.blueGreen
+func (r *AppReconciler) reconcileBlueGreen(ctx context.Context, app *aloysv1.App, children *appChildren) error {
+	logger := log.FromContext(ctx)
+
+	configHash, err := r.configHash(ctx, app)
+	if err != nil {
+		return err
+	}
+	revision, err := templateHash(app, configHash)
+	if err != nil {
+		return err
+	}
+	st := children.blueGreenStatus
+	if st == nil {
+		st = &aloysv1.BlueGreenStatus{}
+		children.blueGreenStatus = st
+	}
+
+	var active *appsv1.Deployment
+	if st.ActiveColor != "" {
+		if active, err = r.getDeployment(ctx, app, colorName(app, st.ActiveColor)); err != nil {
+			return err
+		}
+		if active == nil {
+			// 当前颜色的 Deployment 被手动删除，重新走一遍发布流程
+			logger.Info("active color is missing, starting over", "color", st.ActiveColor)
+			*st = aloysv1.BlueGreenStatus{}
+		}
+	}
+
+	// 副本数：开启自动扩缩容时沿用 HPA 为当前颜色选择的副本数
+	replicas := ptr.Deref(app.Spec.Replicas, 1)
+	if app.Spec.Autoscaling != nil {
+		replicas = initialReplicas(app)
+		if active != nil {
+			replicas = ptr.Deref(active.Spec.Replicas, replicas)
+		}
+	}
+
+	if st.ActiveColor != "" && st.ActiveRevision == revision {
+		// 没有新版本：保持当前颜色和 spec 一致，到期后缩容上一个颜色
+		if children.deployment, err = r.applyColorDeployment(ctx, app, children, st.ActiveColor, configHash, replicas, app.Spec.Autoscaling != nil); err != nil {
+			return err
+		}
+		return r.scaleDownPrevious(ctx, app, children)
+	}
+
+	// 新版本发布到 preview 颜色
+	previewColor := colorBlue
+	if st.ActiveColor != "" {
+		previewColor = otherColor(st.ActiveColor)
+	}
+	if st.PreviewColor != previewColor || st.PreviewRevision != revision {
+		logger.Info("rolling out new revision to the preview color", "color", previewColor, "revision", revision)
+	}
+	st.PreviewColor, st.PreviewRevision, st.ScaleDownAt = previewColor, revision, nil
+	preview, err := r.applyColorDeployment(ctx, app, children, previewColor, configHash, replicas, false)
+	if err != nil {
+		return err
+	}
+	children.deployment, children.previewDeployment = active, preview
+	if !deploymentRollout(preview).complete {
+		return nil
+	}
+
+	// preview 全部可用后才切换 Service
+	logger.Info("switching the App to the preview color", "color", previewColor, "revision", revision)
+	st.PreviewColor, st.PreviewRevision = st.ActiveColor, st.ActiveRevision
+	st.ActiveColor, st.ActiveRevision = previewColor, revision
+	children.deployment, children.previewDeployment = preview, active
+	r.eventf(app, corev1.EventTypeNormal, eventRolloutPromoted, "Switched the App to the %s color running revision %s", previewColor, revision)
+	if st.PreviewColor == "" {
+		return nil
+	}
+	delay := scaleDownDelay(app)
+	st.ScaleDownAt = ptr.To(metav1.NewTime(time.Now().Add(delay)))
+	children.requeueAfter = delay
+	return nil
+}
+
+// scaleDownPrevious scales the previous color to zero once its scale-down delay expired.
+// 缩容到 0 而不是删除，下一次发布直接复用这个 Deployment
+func (r *AppReconciler) scaleDownPrevious(ctx context.Context, app *aloysv1.App, children *appChildren) error {
+	st := children.blueGreenStatus
+	if st.PreviewColor == "" {
+		return nil
+	}
+	previous, err := r.getDeployment(ctx, app, colorName(app, st.PreviewColor))
+	if err != nil || previous == nil {
+		return err
+	}
+	children.previewDeployment = previous
+	if st.ScaleDownAt != nil {
+		if remaining := time.Until(st.ScaleDownAt.Time); remaining > 0 {
+			children.requeueAfter = remaining
+			return nil
+		}
+	}
+	if ptr.Deref(previous.Spec.Replicas, 1) == 0 {
+		return nil
+	}
+	log.FromContext(ctx).Info("scaling down the previous color", "color", st.PreviewColor)
+	return r.scaleDeployment(ctx, app, children, previous, 0)
+}
+
+// applyColorDeployment applies the Deployment of a color with the App's pod template.
+// scaledByHPA is true for the active color when autoscaling is enabled, see applyDeployment.
+func (r *AppReconciler) applyColorDeployment(ctx context.Context, app *aloysv1.App, children *appChildren, color, configHash string, replicas int32, scaledByHPA bool) (*appsv1.Deployment, error) {
+	deploy, applied, err := r.applyDeployment(ctx, app, children, colorName(app, color), scaledByHPA, func(deploy *appsv1.Deployment) {
+		mutateColorDeployment(app, deploy, color, configHash, replicas)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if applied {
+		log.FromContext(ctx).Info("applied color deployment", "deployment", deploy.Name, "replicas", replicas)
+	}
+	return deploy, nil
+}
+
+// mutateColorDeployment sets the fields of the Deployment of a color.
+func mutateColorDeployment(app *aloysv1.App, deploy *appsv1.Deployment, color, configHash string, replicas int32) {
+	mutateDeployment(app, deploy, configHash)
+	deploy.Labels[colorLabelKey] = color
+	deploy.Spec.Replicas = ptr.To(replicas)
+	if deploy.Spec.Selector.MatchLabels[colorLabelKey] == "" {
+		deploy.Spec.Selector.MatchLabels[colorLabelKey] = color
+	}
+	deploy.Spec.Template.Labels[colorLabelKey] = color
+}
+
+// reconcilePreviewService creates or updates the preview Service selecting the preview color,
+// or deletes it when there is nothing to preview.
+// preview Service 只在集群内部访问，固定为 ClusterIP
+func (r *AppReconciler) reconcilePreviewService(ctx context.Context, app *aloysv1.App, children *appChildren) error {
+	st := children.blueGreenStatus
+	key := types.NamespacedName{Namespace: app.Namespace, Name: previewName(app)}
+	if app.Spec.Service == nil || st == nil || st.PreviewColor == "" {
+		return r.deleteOwned(ctx, app, &corev1.Service{}, key)
+	}
+	_, err := r.applyService(ctx, app, children, key.Name, corev1.ServiceTypeClusterIP, colorSelector(app, st.PreviewColor))
+	return err
+}
+
+// cleanupBlueGreen deletes the color Deployments once the App no longer uses the blue/green strategy.
+func (r *AppReconciler) cleanupBlueGreen(ctx context.Context, app *aloysv1.App) error {
+	for _, color := range []string{colorBlue, colorGreen} {
+		key := types.NamespacedName{Namespace: app.Namespace, Name: colorName(app, color)}
+		if err := r.deleteOwned(ctx, app, &appsv1.Deployment{}, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaleDownDelay returns the scale-down delay of the previous color.
+func scaleDownDelay(app *aloysv1.App) time.Duration {
+	if d := app.Spec.Strategy.BlueGreen.ScaleDownDelay; d != nil {
+		return d.Duration
+	}
+	return defaultScaleDownDelay
+}
+
+// getDeployment returns the Deployment with the given name, or nil when it does not exist.
+func (r *AppReconciler) getDeployment(ctx context.Context, app *aloysv1.App, name string) (*appsv1.Deployment, error) {
+	deploy := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: app.Namespace, Name: name}, deploy); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return deploy, nil
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+const (
+	// trackLabelKey 区分 stable 和 canary 的 Pod，两个 Deployment 的 selector 互不重叠。
+	// 旧版本创建的 stable Deployment 的 selector 没有这个标签，selector 创建后不能修改，这些 Deployment 保持原样
+	trackLabelKey = "aloys.tech/track"
+	trackStable   = "stable"
+	trackCanary   = "canary"
+)
+
+// canaryName returns the name of the canary Deployment of the App.
+func canaryName(app *aloysv1.App) string {
+	return app.Name + "-canary"
+}
+
+// isCanary reports whether the App is rolled out with the canary strategy.
+func isCanary(app *aloysv1.App) bool {
+	return app.Spec.Strategy != nil && app.Spec.Strategy.Canary != nil
+}
+
+// templateHash returns a hash of the pod template generated for the App, identifying a revision of the workload.
+func templateHash(app *aloysv1.App, configHash string) (string, error) {
+	deploy := &appsv1.Deployment{}
+	mutateDeployment(app, deploy, configHash)
+	data, err := json.Marshal(deploy.Spec.Template)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:10], nil
+}
+
+// templateUpToDate reports whether the pod template of the Deployment matches the App spec.
+// 在副本上执行一次 mutate 再比较，apiserver 填充的默认值不会导致误判
+func templateUpToDate(app *aloysv1.App, deploy *appsv1.Deployment, configHash string) bool {
+	desired := deploy.DeepCopy()
+	mutateStableDeployment(app, desired, configHash)
+	return equality.Semantic.DeepEqual(desired.Spec.Template, deploy.Spec.Template)
+}
+
+// reconcileCanary runs a canary rollout: the stable Deployment keeps the current pod template while
+// a second Deployment runs the new one, and replicas are shifted to it following spec.strategy.canary.steps.
+// 每一步的状态记录在 children.canaryStatus 中，由 updateStatus 写回 status.canary
+func (r *AppReconciler) reconcileCanary(ctx context.Context, app *aloysv1.App, children *appChildren) error {
+	logger := log.FromContext(ctx)
+
+	configHash, err := r.configHash(ctx, app)
+	if err != nil {
+		return err
+	}
+	revision, err := templateHash(app, configHash)
+	if err != nil {
+		return err
+	}
+	st := children.canaryStatus
+
+	stable := &appsv1.Deployment{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: app.Namespace, Name: app.Name}, stable); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		// 第一次部署没有可以对比的 stable 版本，直接创建
+		children.canaryStatus = nil
+		if children.deployment, err = r.reconcileDeployment(ctx, app, children); err != nil {
+			return err
+		}
+		return r.deleteCanary(ctx, app)
+	}
+	children.deployment = stable
+
+	if templateUpToDate(app, stable, configHash) {
+		// stable 已经是最新版本：等 stable 滚动完成后再删除 canary，保证过程中始终有可用的新版本 Pod
+		if children.deployment, err = r.reconcileDeployment(ctx, app, children); err != nil {
+			return err
+		}
+		if st != nil && (st.Revision != revision || !st.Promoted) {
+			children.canaryStatus = nil
+		}
+		if !deploymentRollout(children.deployment).complete {
+			children.canaryDeployment, err = r.getCanary(ctx, app)
+			return err
+		}
+		return r.deleteCanary(ctx, app)
+	}
+
+	// 新版本开始或者 pod 模板在 canary 过程中再次变化，都从第一步重新开始
+	if st == nil || st.Revision != revision {
+		st = &aloysv1.CanaryStatus{Revision: revision}
+		children.canaryStatus = st
+		logger.Info("starting canary rollout", "revision", revision)
+	}
+
+	switch {
+	case app.Annotations[aloysv1.AnnotationCanaryPromote] == "true":
+		logger.Info("canary promoted manually", "revision", revision)
+		if err := r.removeAnnotations(ctx, app, aloysv1.AnnotationCanaryPromote, aloysv1.AnnotationCanaryAbort); err != nil {
+			return err
+		}
+		return r.promoteCanary(ctx, app, children)
+	case app.Annotations[aloysv1.AnnotationCanaryAbort] == "true":
+		logger.Info("canary aborted manually", "revision", revision)
+		if err := r.removeAnnotations(ctx, app, aloysv1.AnnotationCanaryAbort); err != nil {
+			return err
+		}
+		r.warningf(app, eventRolloutAborted, "Aborted the canary of revision %s by the %s annotation", revision, aloysv1.AnnotationCanaryAbort)
+		recordRollout(rolloutAborted)
+		st.Aborted = true
+	}
+
+	total := ptr.Deref(app.Spec.Replicas, 1)
+	if app.Spec.Autoscaling != nil {
+		total = ptr.Deref(stable.Spec.Replicas, 1)
+	}
+
+	if st.Aborted {
+		// 中止后 stable 恢复全部副本，同一个版本不再重试，直到 pod 模板再次变化
+		if err := r.scaleStable(ctx, app, children, stable, total); err != nil {
+			return err
+		}
+		return r.deleteCanary(ctx, app)
+	}
+
+	steps := app.Spec.Strategy.Canary.Steps
+	if int(st.CurrentStep) >= len(steps) {
+		// 步骤在 canary 过程中被删减，已经没有剩余的步骤
+		return r.promoteCanary(ctx, app, children)
+	}
+	step := steps[st.CurrentStep]
+	st.Weight = step.Weight
+	canaryReplicas := (total*step.Weight + 99) / 100
+
+	// canary 的副本数始终由 controller 决定，HPA 只作用于 stable Deployment
+	canary, applied, err := r.applyDeployment(ctx, app, children, canaryName(app), false, func(deploy *appsv1.Deployment) {
+		mutateCanaryDeployment(app, deploy, configHash, canaryReplicas)
+	})
+	if err != nil {
+		return err
+	}
+	if applied {
+		logger.Info("applied canary deployment", "deployment", canary.Name, "replicas", canaryReplicas)
+	}
+	children.canaryDeployment = canary
+	if err := r.scaleStable(ctx, app, children, stable, total-canaryReplicas); err != nil {
+		return err
+	}
+
+	// canary 的 Pod 全部可用之后才开始计算暂停时间
+	if !deploymentRollout(canary).complete {
+		return nil
+	}
+	if st.StepStartedAt == nil {
+		st.StepStartedAt = ptr.To(metav1.Now())
+	}
+	if step.Pause == nil {
+		// 没有设置暂停时间，等待手动 promote
+		return nil
+	}
+	if remaining := step.Pause.Duration - time.Since(st.StepStartedAt.Time); remaining > 0 {
+		children.requeueAfter = remaining
+		return nil
+	}
+
+	st.CurrentStep++
+	st.StepStartedAt = nil
+	if int(st.CurrentStep) >= len(steps) {
+		logger.Info("canary completed all steps, promoting", "revision", revision)
+		return r.promoteCanary(ctx, app, children)
+	}
+	st.Weight = steps[st.CurrentStep].Weight
+	logger.Info("canary moved to the next step", "revision", revision, "step", st.CurrentStep, "weight", st.Weight)
+	// 立即处理下一步
+	children.requeueAfter = time.Millisecond
+	return nil
+}
+
+// promoteCanary rolls the new pod template out to the stable Deployment. The canary Deployment is
+// removed once the stable Deployment finished rolling out.
+func (r *AppReconciler) promoteCanary(ctx context.Context, app *aloysv1.App, children *appChildren) error {
+	st := children.canaryStatus
+	st.Promoted = true
+	st.Aborted = false
+	st.CurrentStep = int32(len(app.Spec.Strategy.Canary.Steps))
+	st.Weight = 100
+	st.StepStartedAt = nil
+
+	var err error
+	if children.deployment, err = r.reconcileDeployment(ctx, app, children); err != nil {
+		return err
+	}
+	r.eventf(app, corev1.EventTypeNormal, eventRolloutPromoted, "Promoted the canary of revision %s to the stable Deployment", st.Revision)
+	children.canaryDeployment, err = r.getCanary(ctx, app)
+	return err
+}
+
+// mutateCanaryDeployment sets the fields of the canary Deployment. It runs the same pod template
+// as the stable Deployment would, with the track label added.
+func mutateCanaryDeployment(app *aloysv1.App, deploy *appsv1.Deployment, configHash string, replicas int32) {
+	mutateDeployment(app, deploy, configHash)
+	deploy.Labels[trackLabelKey] = trackCanary
+	deploy.Spec.Replicas = ptr.To(replicas)
+	if deploy.Spec.Selector.MatchLabels[trackLabelKey] == "" {
+		deploy.Spec.Selector.MatchLabels[trackLabelKey] = trackCanary
+	}
+	deploy.Spec.Template.Labels[trackLabelKey] = trackCanary
+}
+
+// mutateStableDeployment sets the fields of the stable Deployment. A new stable Deployment selects
+// its pods by the stable track label so that it does not adopt the pods of the canary Deployment.
+func mutateStableDeployment(app *aloysv1.App, deploy *appsv1.Deployment, configHash string) {
+	created := deploy.Spec.Selector == nil
+	mutateDeployment(app, deploy, configHash)
+	if created {
+		deploy.Spec.Selector.MatchLabels[trackLabelKey] = trackStable
+	}
+	if deploy.Spec.Selector.MatchLabels[trackLabelKey] == trackStable {
+		deploy.Spec.Template.Labels[trackLabelKey] = trackStable
+	}
+}
+
+// scaleStable sets the replicas of the stable Deployment during a canary rollout.
+// 开启自动扩缩容时 stable 的副本数由 HPA 决定，canary 的副本在此基础上额外增加
+func (r *AppReconciler) scaleStable(ctx context.Context, app *aloysv1.App, children *appChildren, stable *appsv1.Deployment, replicas int32) error {
+	if app.Spec.Autoscaling != nil || ptr.Deref(stable.Spec.Replicas, 1) == replicas {
+		return nil
+	}
+	log.FromContext(ctx).Info("scaling stable deployment", "deployment", stable.Name, "replicas", replicas)
+	return r.scaleDeployment(ctx, app, children, stable, replicas)
+}
+
+// getCanary returns the canary Deployment of the App, or nil when it does not exist.
+func (r *AppReconciler) getCanary(ctx context.Context, app *aloysv1.App) (*appsv1.Deployment, error) {
+	return r.getDeployment(ctx, app, canaryName(app))
+}
+
+// deleteCanary deletes the canary Deployment of the App if it exists.
+func (r *AppReconciler) deleteCanary(ctx context.Context, app *aloysv1.App) error {
+	return r.deleteOwned(ctx, app, &appsv1.Deployment{}, types.NamespacedName{Namespace: app.Namespace, Name: canaryName(app)})
+}
+
+// removeAnnotations removes the given annotations from the App once they have been handled.
+func (r *AppReconciler) removeAnnotations(ctx context.Context, app *aloysv1.App, keys ...string) error {
+	err := r.patchApp(ctx, app, func(app *aloysv1.App) {
+		for _, key := range keys {
+			delete(app.Annotations, key)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("unable to remove annotations %v: %w", keys, err)
+	}
+	return nil
+}
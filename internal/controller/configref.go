@@ -0,0 +1,287 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+const (
+	// configRefIndexKey 是 App 上的字段索引，值为 App 引用的 ConfigMap 和 Secret，格式为 "ConfigMap/<name>" 或 "Secret/<name>"
+	// 有了这个索引，ConfigMap 或 Secret 变化时可以直接从缓存中查出引用它的 App
+	configRefIndexKey = ".spec.configRefs"
+	// configHashAnnotation 记录 App 引用的所有 ConfigMap 和 Secret 内容的 hash，写在 Pod 模板上，内容变化时触发滚动更新
+	configHashAnnotation = "aloys.tech/config-hash"
+
+	configMapKind = "ConfigMap"
+	secretKind    = "Secret"
+)
+
+// configRef identifies a ConfigMap or Secret referenced by an App.
+type configRef struct {
+	kind string
+	name string
+}
+
+func (c configRef) String() string {
+	return c.kind + "/" + c.name
+}
+
+// configRefs returns the ConfigMaps and Secrets referenced by the App, sorted and without duplicates.
+func configRefs(app *aloysv1.App) []configRef {
+	seen := map[configRef]bool{}
+	add := func(kind, name string) {
+		if name != "" {
+			seen[configRef{kind: kind, name: name}] = true
+		}
+	}
+
+	for _, env := range app.Spec.Env {
+		if env.ValueFrom == nil {
+			continue
+		}
+		if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+			add(configMapKind, ref.Name)
+		}
+		if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+			add(secretKind, ref.Name)
+		}
+	}
+	for _, envFrom := range app.Spec.EnvFrom {
+		if ref := envFrom.ConfigMapRef; ref != nil {
+			add(configMapKind, ref.Name)
+		}
+		if ref := envFrom.SecretRef; ref != nil {
+			add(secretKind, ref.Name)
+		}
+	}
+	for _, vol := range app.Spec.Volumes {
+		if vol.ConfigMap != nil {
+			add(configMapKind, vol.ConfigMap.Name)
+		}
+		if vol.Secret != nil {
+			add(secretKind, vol.Secret.SecretName)
+		}
+		if vol.Projected != nil {
+			for _, src := range vol.Projected.Sources {
+				if src.ConfigMap != nil {
+					add(configMapKind, src.ConfigMap.Name)
+				}
+				if src.Secret != nil {
+					add(secretKind, src.Secret.Name)
+				}
+			}
+		}
+	}
+
+	refs := make([]configRef, 0, len(seen))
+	for ref := range seen {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].String() < refs[j].String() })
+	return refs
+}
+
+// indexConfigRefs is the field index function of configRefIndexKey.
+func indexConfigRefs(obj client.Object) []string {
+	app, ok := obj.(*aloysv1.App)
+	if !ok {
+		return nil
+	}
+	refs := configRefs(app)
+	keys := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		keys = append(keys, ref.String())
+	}
+	return keys
+}
+
+// configHash returns a hash of the content of every ConfigMap and Secret referenced by the App,
+// or an empty string when the App references none.
+// 不存在的对象也参与计算，这样对象被创建之后同样会触发滚动更新
+// ConfigMap 和 Secret 只缓存了元数据，先比较缓存中的 resourceVersion，只有变化时才从 apiserver 读取内容重新计算
+func (r *AppReconciler) configHash(ctx context.Context, app *aloysv1.App) (string, error) {
+	refs := configRefs(app)
+	if len(refs) == 0 {
+		return "", nil
+	}
+
+	key := client.ObjectKeyFromObject(app)
+	versions, err := r.configVersions(ctx, app, refs)
+	if err != nil {
+		return "", err
+	}
+	if hash, ok := r.configHashes.get(key, versions); ok {
+		return hash, nil
+	}
+	hash, err := r.readConfigHash(ctx, app, refs)
+	if err != nil {
+		return "", err
+	}
+	r.configHashes.set(key, versions, hash)
+	return hash, nil
+}
+
+// configVersions returns the resource versions of the ConfigMaps and Secrets referenced by the App,
+// read from the metadata-only cache. A missing object has an empty resource version.
+func (r *AppReconciler) configVersions(ctx context.Context, app *aloysv1.App, refs []configRef) (string, error) {
+	var versions strings.Builder
+	for _, ref := range refs {
+		obj := &metav1.PartialObjectMetadata{}
+		obj.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind(ref.kind))
+		if err := r.Get(ctx, types.NamespacedName{Namespace: app.Namespace, Name: ref.name}, obj); client.IgnoreNotFound(err) != nil {
+			return "", err
+		}
+		versions.WriteString(ref.String() + "=" + obj.ResourceVersion + "\n")
+	}
+	return versions.String(), nil
+}
+
+// readConfigHash computes the hash of configHash from the content read from the apiserver.
+// 通过缓存的 Client 读取内容会为 ConfigMap 和 Secret 启动完整的 informer，所以直接读 apiserver
+func (r *AppReconciler) readConfigHash(ctx context.Context, app *aloysv1.App, refs []configRef) (string, error) {
+	h := sha256.New()
+	for _, ref := range refs {
+		h.Write([]byte(ref.String()))
+		h.Write([]byte{0})
+
+		key := types.NamespacedName{Namespace: app.Namespace, Name: ref.name}
+		var data map[string][]byte
+		switch ref.kind {
+		case configMapKind:
+			cm := &corev1.ConfigMap{}
+			if err := r.apiReader().Get(ctx, key, cm); err != nil {
+				if client.IgnoreNotFound(err) != nil {
+					return "", err
+				}
+				continue
+			}
+			data = make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+			for k, v := range cm.Data {
+				data[k] = []byte(v)
+			}
+			for k, v := range cm.BinaryData {
+				data[k] = v
+			}
+		case secretKind:
+			secret := &corev1.Secret{}
+			if err := r.apiReader().Get(ctx, key, secret); err != nil {
+				if client.IgnoreNotFound(err) != nil {
+					return "", err
+				}
+				continue
+			}
+			data = secret.Data
+		}
+
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			h.Write([]byte(k))
+			h.Write([]byte{0})
+			h.Write(data[k])
+			h.Write([]byte{0})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// configHashCache remembers the config hash of every App with the resource versions of the ConfigMaps
+// and Secrets it was computed from, so their content is only read again once one of them changed.
+// The zero value is ready to use.
+type configHashCache struct {
+	mu      sync.Mutex
+	entries map[types.NamespacedName]configHashEntry
+}
+
+type configHashEntry struct {
+	versions string
+	hash     string
+}
+
+// get returns the hash of the App if it was computed from the same resource versions.
+func (c *configHashCache) get(app types.NamespacedName, versions string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[app]
+	if !ok || entry.versions != versions {
+		return "", false
+	}
+	return entry.hash, true
+}
+
+func (c *configHashCache) set(app types.NamespacedName, versions, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[types.NamespacedName]configHashEntry{}
+	}
+	c.entries[app] = configHashEntry{versions: versions, hash: hash}
+}
+
+// forget drops the hash of a deleted App.
+func (c *configHashCache) forget(app types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, app)
+}
+
+// apiReader returns the reader that bypasses the informer cache, for the objects that are not kept
+// in the cache and for the reads that must see the latest version of an object.
+func (r *AppReconciler) apiReader() client.Reader {
+	if r.APIReader != nil {
+		return r.APIReader
+	}
+	return r.Client
+}
+
+// appsForConfig returns a map function enqueuing the Apps that reference a ConfigMap or Secret of the given kind.
+func (r *AppReconciler) appsForConfig(kind string) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		apps := &aloysv1.AppList{}
+		ref := configRef{kind: kind, name: obj.GetName()}
+		if err := r.List(ctx, apps, client.InNamespace(obj.GetNamespace()), client.MatchingFields{configRefIndexKey: ref.String()}); err != nil {
+			log.FromContext(ctx).Error(err, "unable to list Apps referencing object", "object", ref.String())
+			return nil
+		}
+		requests := make([]reconcile.Request, 0, len(apps.Items))
+		for _, app := range apps.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: app.Namespace, Name: app.Name},
+			})
+		}
+		return requests
+	}
+}
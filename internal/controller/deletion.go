@@ -0,0 +1,310 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+const (
+	// finalizeRequeueDelay is how long the finalizer waits before checking again that the deletion policy has been applied.
+	finalizeRequeueDelay = 2 * time.Second
+	// maxCleanupRetryDelay caps the backoff between failed cleanup attempts.
+	maxCleanupRetryDelay = 5 * time.Minute
+	// defaultCleanupTimeout is how long the cleanup may take before the CleanupStalled condition is set,
+	// when AppReconciler.CleanupTimeout is not set.
+	defaultCleanupTimeout = 10 * time.Minute
+)
+
+// reasonCleanupTimeout is the reason of the CleanupStalled condition.
+const reasonCleanupTimeout = "CleanupTimeout"
+
+// reconcileDelete runs the cleanup of a deleted App and removes its finalizers once the cleanup is
+// complete, or when the force-finalize annotation is set and the cleanup is still incomplete.
+// Every failed attempt is recorded in status.cleanup, so a stuck deletion explains itself.
+// 清理失败时按照尝试次数退避，status 更新触发的 Reconcile 也不会提前重试
+func (r *AppReconciler) reconcileDelete(ctx context.Context, app *aloysv1.App) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	reason, force := app.Annotations[aloysv1.AnnotationForceFinalize]
+	force = force && strings.TrimSpace(reason) != ""
+	// 设置了 force-finalize 注解时不等待退避，立即最后尝试一次清理
+	if wait := cleanupRetryDelay(app.Status.Cleanup) - time.Since(cleanupLastAttempt(app.Status.Cleanup)); wait > 0 && !force {
+		return ctrl.Result{RequeueAfter: wait}, nil
+	}
+
+	done, cleanupErr := r.finalize(ctx, app)
+	attempts := int32(1)
+	if app.Status.Cleanup != nil {
+		attempts += app.Status.Cleanup.Attempts
+	}
+	if done && cleanupErr == nil {
+		logger.Info("cleanup complete, releasing App", "attempts", attempts)
+		r.eventf(app, corev1.EventTypeNormal, eventCleanupSucceeded, "Cleaned up the resources of the App after %d attempt(s)", attempts)
+		recordCleanup(app, cleanupSucceeded)
+		return ctrl.Result{}, r.removeFinalizers(ctx, app)
+	}
+
+	if force {
+		incomplete := "child resources are still being released"
+		if cleanupErr != nil {
+			incomplete = cleanupErr.Error()
+		}
+		logger.Info("force-finalizing App with an incomplete cleanup", "reason", reason, "attempts", attempts, "cleanup", incomplete)
+		r.warningf(app, eventForceFinalized, "Removed the finalizer by the %s annotation (reason: %q) after %d cleanup attempt(s); the cleanup is incomplete: %s",
+			aloysv1.AnnotationForceFinalize, reason, attempts, incomplete)
+		recordCleanup(app, cleanupForced)
+		return ctrl.Result{}, r.removeFinalizers(ctx, app)
+	}
+
+	if cleanupErr != nil {
+		r.warningf(app, eventCleanupFailed, "Cleanup attempt %d failed: %v", attempts, cleanupErr)
+	}
+	if statusErr := r.updateCleanupStatus(ctx, app, cleanupErr); statusErr != nil {
+		logger.Error(statusErr, "unable to update the cleanup status of the App")
+	}
+	if cleanupErr != nil {
+		// 返回错误，由 client-go-Controller 记录错误并重新入队；下一次尝试的时间由 status.cleanup 决定
+		return ctrl.Result{}, cleanupErr
+	}
+	// 子资源还没有全部删除或者去掉 ownerReference，稍后再检查
+	return ctrl.Result{RequeueAfter: finalizeRequeueDelay}, nil
+}
+
+// updateCleanupStatus records a failed cleanup attempt in status.cleanup and sets the CleanupStalled
+// condition once the App has been deleted for longer than the cleanup timeout. Waiting for the
+// children to be released is not an attempt, and the status is only patched when it changed.
+// 等待子资源释放时每 2 秒检查一次，如果也计入尝试次数，退避时间会不断增加，status 也会被频繁更新
+func (r *AppReconciler) updateCleanupStatus(ctx context.Context, app *aloysv1.App, cleanupErr error) error {
+	now := metav1.Now()
+	status := app.Status.DeepCopy()
+	if status.Cleanup == nil {
+		status.Cleanup = &aloysv1.CleanupStatus{StartTime: now}
+	}
+	status.Cleanup.LastError = ""
+	if cleanupErr != nil {
+		status.Cleanup.Attempts++
+		status.Cleanup.LastAttemptTime = &now
+		status.Cleanup.LastError = cleanupErr.Error()
+	}
+	status.Phase = aloysv1.AppPhaseTerminating
+
+	timeout := r.CleanupTimeout
+	if timeout <= 0 {
+		timeout = defaultCleanupTimeout
+	}
+	// 超时从删除 App 的时间开始计算
+	if elapsed := now.Sub(app.DeletionTimestamp.Time); elapsed >= timeout {
+		msg := fmt.Sprintf("cleanup did not complete within %s after %d attempts", timeout, status.Cleanup.Attempts)
+		if status.Cleanup.LastError != "" {
+			msg += ": " + status.Cleanup.LastError
+		}
+		msg += fmt.Sprintf("; set the %s annotation to release the App anyway", aloysv1.AnnotationForceFinalize)
+		if !meta.IsStatusConditionTrue(status.Conditions, aloysv1.ConditionCleanupStalled) {
+			r.warningf(app, eventCleanupStalled, "%s", msg)
+		}
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               aloysv1.ConditionCleanupStalled,
+			Status:             metav1.ConditionTrue,
+			Reason:             reasonCleanupTimeout,
+			Message:            msg,
+			ObservedGeneration: app.Generation,
+		})
+	}
+
+	if equality.Semantic.DeepEqual(&app.Status, status) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.patchStatus(ctx, app, status))
+}
+
+// removeFinalizers removes the finalizer of the controller, and the legacy one, from the App.
+func (r *AppReconciler) removeFinalizers(ctx context.Context, app *aloysv1.App) error {
+	// 清空 finalizers 后 Kubernetes 删除对应资源
+	return client.IgnoreNotFound(r.patchApp(ctx, app, func(app *aloysv1.App) {
+		app.ObjectMeta.Finalizers = removeString(removeString(app.ObjectMeta.
+			Finalizers, appFinalizer), legacyFinalizer)
+	}))
+}
+
+// cleanupRetryDelay is the delay before the next cleanup attempt: finalizeRequeueDelay while the
+// children are being released, doubled for every failed attempt up to maxCleanupRetryDelay.
+func cleanupRetryDelay(cleanup *aloysv1.CleanupStatus) time.Duration {
+	if cleanup == nil || cleanup.LastError == "" {
+		return finalizeRequeueDelay
+	}
+	delay := finalizeRequeueDelay
+	for i := int32(1); i < cleanup.Attempts && delay < maxCleanupRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxCleanupRetryDelay {
+		delay = maxCleanupRetryDelay
+	}
+	return delay
+}
+
+// cleanupLastAttempt returns when the last cleanup attempt ran, or the zero time before the first one.
+func cleanupLastAttempt(cleanup *aloysv1.CleanupStatus) time.Time {
+	if cleanup == nil || cleanup.LastAttemptTime == nil {
+		return time.Time{}
+	}
+	return cleanup.LastAttemptTime.Time
+}
+
+// childKind is a kind of resource that can be owned by an App.
+type childKind struct {
+	kind    string
+	newList func() client.ObjectList
+}
+
+// childKinds lists the kinds of resources the deletion policy is applied to. PersistentVolumeClaims
+// are not created by the controller, but the ones labelled with the App name whose owner reference
+// points to the App are handled too.
+var childKinds = []childKind{
+	{kind: "Deployment", newList: func() client.ObjectList { return &appsv1.DeploymentList{} }},
+	{kind: "Service", newList: func() client.ObjectList { return &corev1.ServiceList{} }},
+	{kind: "Ingress", newList: func() client.ObjectList { return &networkingv1.IngressList{} }},
+	{kind: "HorizontalPodAutoscaler", newList: func() client.ObjectList { return &autoscalingv2.HorizontalPodAutoscalerList{} }},
+	{kind: "ControllerRevision", newList: func() client.ObjectList { return &appsv1.ControllerRevisionList{} }},
+	{kind: "PersistentVolumeClaim", newList: func() client.ObjectList { return &corev1.PersistentVolumeClaimList{} }},
+}
+
+// finalize applies spec.deletionPolicy to the child and external resources of a deleted App.
+// It returns true once the policy has been applied and confirmed, i.e. no child that has to be
+// deleted or orphaned is still owned by the App, so the finalizer can be removed.
+// 不依赖垃圾回收器：删除或去掉 ownerReference 之后重新检查，全部处理完成才释放 App
+func (r *AppReconciler) finalize(ctx context.Context, app *aloysv1.App) (bool, error) {
+	logger := log.FromContext(ctx)
+	policy := app.Spec.DeletionPolicy
+	if policy == "" {
+		// 没有经过 webhook 创建的 App 使用配置文件中的默认策略
+		policy = r.Config.Get().Defaults.DeletionPolicy
+	}
+
+	for _, ck := range childKinds {
+		orphan := policy == aloysv1.DeletionPolicyOrphan ||
+			(policy == aloysv1.DeletionPolicyRetain && retainsKind(app, ck.kind))
+		children, err := r.ownedChildren(ctx, app, ck)
+		if err != nil {
+			return false, err
+		}
+		for _, child := range children {
+			if orphan {
+				if err := r.removeOwnerReference(ctx, app, child); err != nil {
+					return false, err
+				}
+				logger.Info("orphaned child resource", "kind", ck.kind, "name", child.GetName())
+				continue
+			}
+			if !child.GetDeletionTimestamp().IsZero() {
+				continue
+			}
+			if err := r.Delete(ctx, child, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+				return false, err
+			}
+			logger.Info("deleted child resource", "kind", ck.kind, "name", child.GetName())
+		}
+	}
+
+	if policy != aloysv1.DeletionPolicyOrphan {
+		if err := r.deleteExternalResources(ctx, app); err != nil {
+			return false, err
+		}
+	}
+
+	// 重新列出子资源，确认已经全部删除或者不再属于 App
+	for _, ck := range childKinds {
+		children, err := r.ownedChildren(ctx, app, ck)
+		if err != nil {
+			return false, err
+		}
+		if len(children) > 0 {
+			logger.Info("waiting for child resources to be released", "kind", ck.kind, "count", len(children), "deletionPolicy", policy)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// retainsKind reports whether children of the kind are kept by the Retain deletion policy.
+func retainsKind(app *aloysv1.App, kind string) bool {
+	kinds := app.Spec.RetainKinds
+	if len(kinds) == 0 {
+		kinds = []string{"PersistentVolumeClaim"}
+	}
+	return containsString(kinds, kind)
+}
+
+// ownedChildren returns the resources of a kind in the App's namespace that carry the App label
+// and have an owner reference to the App.
+// 直接读 API Server：只在删除 App 时调用，不应为没有 watch 的类型（例如 PVC）启动整个集群的 informer
+func (r *AppReconciler) ownedChildren(ctx context.Context, app *aloysv1.App, ck childKind) ([]client.Object, error) {
+	list := ck.newList()
+	if err := r.apiReader().List(ctx, list, client.InNamespace(app.Namespace), client.MatchingLabels(selectorLabels(app))); err != nil {
+		return nil, fmt.Errorf("unable to list %s: %w", ck.kind, err)
+	}
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+	var children []client.Object
+	for _, item := range items {
+		obj, ok := item.(client.Object)
+		if !ok || ownerReferenceIndex(obj, app) < 0 {
+			continue
+		}
+		children = append(children, obj)
+	}
+	return children, nil
+}
+
+// removeOwnerReference removes the owner reference to the App from a child, so the garbage collector keeps it.
+func (r *AppReconciler) removeOwnerReference(ctx context.Context, app *aloysv1.App, child client.Object) error {
+	i := ownerReferenceIndex(child, app)
+	if i < 0 {
+		return nil
+	}
+	patch := client.MergeFrom(child.DeepCopyObject().(client.Object))
+	refs := child.GetOwnerReferences()
+	child.SetOwnerReferences(append(refs[:i:i], refs[i+1:]...))
+	return client.IgnoreNotFound(r.Patch(ctx, child, patch))
+}
+
+func ownerReferenceIndex(obj client.Object, app *aloysv1.App) int {
+	for i, ref := range obj.GetOwnerReferences() {
+		if ref.UID == app.UID {
+			return i
+		}
+	}
+	return -1
+}
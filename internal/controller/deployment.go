@@ -0,0 +1,257 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	appsv1ac "k8s.io/client-go/applyconfigurations/apps/v1"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+const (
+	// appLabelKey 是 App 生成的所有子资源以及 Pod 上都会带的标签，Deployment 的 selector 也只依赖它
+	appLabelKey = "aloys.tech/app"
+	// containerName 是 Deployment 中唯一容器的名称
+	containerName = "app"
+
+	defaultProgressDeadlineSeconds = 600
+)
+
+// selectorLabels returns the labels used to select the pods of an App.
+// selector 一旦创建就不能修改，所以这里只放不会变化的标签
+func selectorLabels(app *aloysv1.App) map[string]string {
+	return map[string]string{
+		appLabelKey: app.Name,
+	}
+}
+
+// appLabels returns the labels put on every child resource of an App.
+func appLabels(app *aloysv1.App) map[string]string {
+	labels := map[string]string{
+		"app.kubernetes.io/name":       app.Name,
+		"app.kubernetes.io/managed-by": "kubebuilder-demo1",
+	}
+	for k, v := range selectorLabels(app) {
+		labels[k] = v
+	}
+	return labels
+}
+
+// reconcileDeployment applies the Deployment owned by the App.
+func (r *AppReconciler) reconcileDeployment(ctx context.Context, app *aloysv1.App, children *appChildren) (*appsv1.Deployment, error) {
+	// 计算引用的 ConfigMap 和 Secret 的 hash，内容变化时 Pod 模板随之变化，从而触发滚动更新
+	configHash, err := r.configHash(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	deploy, applied, err := r.applyDeployment(ctx, app, children, app.Name, app.Spec.Autoscaling != nil, func(deploy *appsv1.Deployment) {
+		mutateStableDeployment(app, deploy, configHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if applied {
+		log.FromContext(ctx).Info("applied deployment", "deployment", deploy.Name)
+	}
+	return deploy, nil
+}
+
+// applyDeployment applies the Deployment with the given name, built from scratch by mutate, with server-side apply.
+// scaledByHPA is true when the HorizontalPodAutoscaler of the App scales the Deployment: the replicas
+// set by mutate are then only applied when the Deployment is created, and the live value is kept
+// applied until the HorizontalPodAutoscaler takes the field over.
+func (r *AppReconciler) applyDeployment(ctx context.Context, app *aloysv1.App, children *appChildren, name string, scaledByHPA bool,
+	mutate func(deploy *appsv1.Deployment)) (*appsv1.Deployment, bool, error) {
+	deploy := &appsv1.Deployment{}
+	owned, err := getOwned(ctx, r.Client, types.NamespacedName{Namespace: app.Namespace, Name: name}, deploy, appsv1ac.ExtractDeployment)
+	if err != nil {
+		return nil, false, err
+	}
+
+	desired := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: app.Namespace}}
+	// selector 不可变，已经存在的 Deployment 沿用当前的 selector，mutate 只在创建时设置
+	if deploy.ResourceVersion != "" {
+		desired.Spec.Selector = deploy.Spec.Selector.DeepCopy()
+	}
+	mutate(desired)
+	// 设置 ownerReference，这样 App 被删除时 Deployment 会被垃圾回收，并且 Deployment 的变化会触发 App 的 Reconcile
+	if err := ctrl.SetControllerReference(app, desired, r.Scheme); err != nil {
+		return nil, false, err
+	}
+	config := appsv1ac.Deployment(name, app.Namespace)
+	if err := toApplyConfiguration(desired, config); err != nil {
+		return nil, false, err
+	}
+	// 发布策略不由 App 决定，不提交空的 strategy
+	config.Status, config.Spec.Strategy = nil, nil
+	// 没有设置 resources 时不提交空的 resources，空对象不会出现在 managedFields 中，否则每次都和已提交的内容不一致
+	for i := range config.Spec.Template.Spec.Containers {
+		if res := config.Spec.Template.Spec.Containers[i].Resources; res != nil && res.Limits == nil && res.Requests == nil && res.Claims == nil {
+			config.Spec.Template.Spec.Containers[i].Resources = nil
+		}
+	}
+	if scaledByHPA && deploy.ResourceVersion != "" {
+		// 开启自动扩缩容后副本数由 HPA 决定：HPA 修改副本数之后字段归 HPA 所有，controller 不再提交
+		config.Spec.Replicas = nil
+		if owned != nil && owned.Spec != nil && owned.Spec.Replicas != nil {
+			config.Spec.Replicas = deploy.Spec.Replicas
+		}
+	}
+
+	applied, err := r.applyObject(ctx, app, children, deploy, config, owned)
+	if err != nil {
+		return nil, false, err
+	}
+	return deploy, applied, nil
+}
+
+// scaleDeployment sets the replicas of a Deployment of the App by applying the fields the controller
+// owns again with the new replica count. Unlike a patch, this keeps the replicas owned by the controller,
+// so the Deployment is not reported as changed outside of the App when its pod template is applied again.
+func (r *AppReconciler) scaleDeployment(ctx context.Context, app *aloysv1.App, children *appChildren, deploy *appsv1.Deployment, replicas int32) error {
+	config, err := appsv1ac.ExtractDeployment(deploy, fieldManager)
+	if err != nil {
+		return err
+	}
+	if config.Spec == nil {
+		config.WithSpec(appsv1ac.DeploymentSpec())
+	}
+	config.Spec.WithReplicas(replicas)
+	_, err = r.applyObject(ctx, app, children, deploy, config, nil)
+	return err
+}
+
+// mutateDeployment sets the fields of the Deployment that are driven by the App spec.
+// 提交时 deploy 是一个空对象，只包含 controller 负责的字段；templateUpToDate 在现有对象的副本上执行，
+// 所以这里只修改 controller 关心的字段，apiserver 设置的默认值保持不变
+func mutateDeployment(app *aloysv1.App, deploy *appsv1.Deployment, configHash string) {
+	if deploy.Labels == nil {
+		deploy.Labels = map[string]string{}
+	}
+	for k, v := range appLabels(app) {
+		deploy.Labels[k] = v
+	}
+
+	// 开启自动扩缩容后副本数由 HPA 决定，controller 只在创建时设置初始副本数，避免和 HPA 来回修改
+	switch {
+	case app.Spec.Autoscaling == nil:
+		deploy.Spec.Replicas = ptr.To(ptr.Deref(app.Spec.Replicas, 1))
+	case deploy.Spec.Replicas == nil:
+		deploy.Spec.Replicas = ptr.To(initialReplicas(app))
+	}
+	// 超过 progressDeadlineSeconds 仍未完成的发布会被自动回滚，默认值和 apiserver 保持一致
+	deploy.Spec.ProgressDeadlineSeconds = ptr.To(ptr.Deref(app.Spec.ProgressDeadlineSeconds, defaultProgressDeadlineSeconds))
+	// selector 是不可变字段，只在创建时设置
+	if deploy.Spec.Selector == nil {
+		deploy.Spec.Selector = &metav1.LabelSelector{MatchLabels: selectorLabels(app)}
+	}
+
+	template := &deploy.Spec.Template
+	if template.Labels == nil {
+		template.Labels = map[string]string{}
+	}
+	for k, v := range appLabels(app) {
+		template.Labels[k] = v
+	}
+	if configHash != "" {
+		if template.Annotations == nil {
+			template.Annotations = map[string]string{}
+		}
+		template.Annotations[configHashAnnotation] = configHash
+	} else {
+		delete(template.Annotations, configHashAnnotation)
+	}
+	template.Spec.Volumes = podVolumes(app.Spec.Volumes)
+	template.Spec.ImagePullSecrets = app.Spec.ImagePullSecrets
+
+	container := findContainer(template.Spec.Containers, containerName)
+	if container == nil {
+		template.Spec.Containers = append(template.Spec.Containers, corev1.Container{Name: containerName})
+		container = &template.Spec.Containers[len(template.Spec.Containers)-1]
+	}
+	container.Image = app.Spec.Image
+	// 和 apiserver 的默认值保持一致，避免每次 Reconcile 都更新 Deployment
+	container.ImagePullPolicy = app.Spec.ImagePullPolicy
+	if container.ImagePullPolicy == "" {
+		container.ImagePullPolicy = aloysv1.DefaultImagePullPolicy(app.Spec.Image)
+	}
+	container.LivenessProbe = app.Spec.LivenessProbe
+	container.ReadinessProbe = app.Spec.ReadinessProbe
+	container.Command = app.Spec.Command
+	container.Args = app.Spec.Args
+	container.Ports = containerPorts(app.Spec.Ports)
+	container.Env = app.Spec.Env
+	container.EnvFrom = app.Spec.EnvFrom
+	container.VolumeMounts = app.Spec.VolumeMounts
+	container.Resources = app.Spec.Resources
+}
+
+// containerPorts returns a copy of ports with the protocol defaulted the same way the apiserver does,
+// otherwise every reconcile would see a difference and update the Deployment.
+func containerPorts(ports []corev1.ContainerPort) []corev1.ContainerPort {
+	if ports == nil {
+		return nil
+	}
+	out := make([]corev1.ContainerPort, len(ports))
+	for i, p := range ports {
+		if p.Protocol == "" {
+			p.Protocol = corev1.ProtocolTCP
+		}
+		out[i] = p
+	}
+	return out
+}
+
+// podVolumes returns a copy of volumes with the file modes defaulted the same way the apiserver does.
+func podVolumes(volumes []corev1.Volume) []corev1.Volume {
+	if volumes == nil {
+		return nil
+	}
+	out := make([]corev1.Volume, len(volumes))
+	for i := range volumes {
+		v := volumes[i].DeepCopy()
+		switch {
+		case v.ConfigMap != nil && v.ConfigMap.DefaultMode == nil:
+			v.ConfigMap.DefaultMode = ptr.To(corev1.ConfigMapVolumeSourceDefaultMode)
+		case v.Secret != nil && v.Secret.DefaultMode == nil:
+			v.Secret.DefaultMode = ptr.To(corev1.SecretVolumeSourceDefaultMode)
+		case v.Projected != nil && v.Projected.DefaultMode == nil:
+			v.Projected.DefaultMode = ptr.To(corev1.ProjectedVolumeSourceDefaultMode)
+		}
+		out[i] = *v
+	}
+	return out
+}
+
+// findContainer returns a pointer to the container with the given name, or nil.
+func findContainer(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
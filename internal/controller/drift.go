@@ -0,0 +1,237 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// maxDriftValueLength is the length the values reported in status.drift are truncated to.
+const maxDriftValueLength = 256
+
+// driftPolicy returns spec.driftPolicy of the App, or the default drift policy of the operator
+// when it is not set, e.g. for an App created while the webhook was disabled.
+func (r *AppReconciler) driftPolicy(app *aloysv1.App) aloysv1.DriftPolicy {
+	if app.Spec.DriftPolicy != "" {
+		return app.Spec.DriftPolicy
+	}
+	return r.Config.Get().Defaults.DriftPolicy
+}
+
+// recordDrift records the drift of a child resource in children.drift and reports it in a Warning Event.
+// 同一个 drift 在 Report 模式下每次 Reconcile 都会检测到，只在第一次检测到时记录 Event
+func (r *AppReconciler) recordDrift(ctx context.Context, app *aloysv1.App, children *appChildren, kind, name string, fields []aloysv1.FieldDrift) {
+	drift := aloysv1.ResourceDrift{
+		Kind:       kind,
+		Name:       name,
+		Fields:     fields,
+		DetectedAt: metav1.Now(),
+		Corrected:  r.driftPolicy(app) != aloysv1.DriftPolicyReport,
+	}
+	if prev := findDrift(children.drift, kind, name); prev != nil {
+		// 同一次 Reconcile 中再次提交同一个子资源
+		prev.Fields, prev.Corrected = fields, drift.Corrected
+		return
+	}
+	children.drift = append(children.drift, drift)
+
+	paths := make([]string, 0, len(fields))
+	for _, f := range fields {
+		paths = append(paths, f.Path)
+	}
+	if prev := findDrift(app.Status.Drift, kind, name); !drift.Corrected && prev != nil && !prev.Corrected &&
+		equality.Semantic.DeepEqual(prev.Fields, fields) {
+		children.drift[len(children.drift)-1].DetectedAt = prev.DetectedAt
+		return
+	}
+	log.FromContext(ctx).Info("child resource was changed outside of the App", "kind", kind, "name", name,
+		"fields", paths, "driftPolicy", r.driftPolicy(app))
+	action := "reverting it to the App spec"
+	if !drift.Corrected {
+		action = "leaving it in place as spec.driftPolicy is Report"
+	}
+	r.warningf(app, eventDriftDetected, "%s %s was changed outside of the App (%s), %s",
+		kind, name, strings.Join(paths, ", "), action)
+}
+
+// driftStatus returns status.drift from the drift detected during the reconcile and the previous status.
+// A corrected drift is kept as a record until the resource drifts again, while a reported drift that was
+// not detected again is resolved. The reported drifts are kept when the reconcile failed, since their
+// resources may not have been checked.
+func driftStatus(prev, detected []aloysv1.ResourceDrift, reconcileFailed bool) []aloysv1.ResourceDrift {
+	drift := append([]aloysv1.ResourceDrift(nil), detected...)
+	for _, d := range prev {
+		if findDrift(detected, d.Kind, d.Name) == nil && (d.Corrected || reconcileFailed) {
+			drift = append(drift, d)
+		}
+	}
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].Kind != drift[j].Kind {
+			return drift[i].Kind < drift[j].Kind
+		}
+		return drift[i].Name < drift[j].Name
+	})
+	return drift
+}
+
+func findDrift(drift []aloysv1.ResourceDrift, kind, name string) *aloysv1.ResourceDrift {
+	for i := range drift {
+		if drift[i].Kind == kind && drift[i].Name == name {
+			return &drift[i]
+		}
+	}
+	return nil
+}
+
+// diffFields returns the fields set in desired whose value differs in live. Only the fields set in
+// desired are compared, so the defaults set by the apiserver and the fields added by other field
+// managers are not reported.
+func diffFields(desired, live map[string]interface{}) []aloysv1.FieldDrift {
+	var fields []aloysv1.FieldDrift
+	for _, k := range sortedKeys(desired) {
+		// apiVersion 和 kind 不会变化，读取的对象中也不一定带有这两个字段
+		if k == "apiVersion" || k == "kind" {
+			continue
+		}
+		diffValue(k, desired[k], live[k], &fields)
+	}
+	return fields
+}
+
+func diffValue(path string, desired, live interface{}, fields *[]aloysv1.FieldDrift) {
+	switch d := desired.(type) {
+	case nil:
+		return
+	case map[string]interface{}:
+		if l, ok := live.(map[string]interface{}); ok {
+			for _, k := range sortedKeys(d) {
+				diffValue(fieldPath(path, k), d[k], l[k], fields)
+			}
+			return
+		}
+	case []interface{}:
+		if l, ok := live.([]interface{}); ok && diffList(path, d, l, fields) {
+			return
+		}
+	default:
+		if equality.Semantic.DeepEqual(desired, live) {
+			return
+		}
+	}
+	*fields = append(*fields, aloysv1.FieldDrift{Path: path, Desired: formatValue(desired), Live: formatValue(live)})
+}
+
+// diffList compares the items of a list. Items with a name, e.g. containers or environment variables,
+// are matched by name, other items by index. It returns false when the lists have to be reported as a whole.
+func diffList(path string, desired, live []interface{}, fields *[]aloysv1.FieldDrift) bool {
+	if names := itemNames(desired); names != nil {
+		for i, item := range desired {
+			var match interface{}
+			for _, l := range live {
+				if m, ok := l.(map[string]interface{}); ok && m["name"] == names[i] {
+					match = m
+					break
+				}
+			}
+			diffValue(fmt.Sprintf("%s[name=%s]", path, names[i]), item, match, fields)
+		}
+		return true
+	}
+	if len(desired) != len(live) {
+		return false
+	}
+	for i := range desired {
+		if _, ok := desired[i].(map[string]interface{}); !ok {
+			return equality.Semantic.DeepEqual(desired, live)
+		}
+	}
+	for i := range desired {
+		diffValue(fmt.Sprintf("%s[%d]", path, i), desired[i], live[i], fields)
+	}
+	return true
+}
+
+// itemNames returns the names of the items of list, or nil when some item has no name.
+func itemNames(list []interface{}) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(list))
+	for _, item := range list {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		name, ok := m["name"].(string)
+		if !ok || name == "" {
+			return nil
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+// fieldPath appends key to path. Keys that are not identifiers, like the keys of labels, are bracketed.
+func fieldPath(path, key string) string {
+	if !identifier.MatchString(key) {
+		return path + "[" + key + "]"
+	}
+	return path + "." + key
+}
+
+// formatValue formats a value for status.drift: strings as they are, other values as JSON.
+func formatValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		s = v
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		s = string(data)
+	}
+	if len(s) > maxDriftValueLength {
+		s = s[:maxDriftValueLength] + "..."
+	}
+	return s
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
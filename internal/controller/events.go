@@ -0,0 +1,138 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// Reasons of the Events recorded on an App.
+const (
+	eventCreated          = "Created"
+	eventUpdated          = "Updated"
+	eventDeleted          = "Deleted"
+	eventFinalizerAdded   = "FinalizerAdded"
+	eventReconcileFailed  = "ReconcileFailed"
+	eventRolloutStarted   = "RolloutStarted"
+	eventRolloutPromoted  = "RolloutPromoted"
+	eventRolloutAborted   = "RolloutAborted"
+	eventRolledBack       = "RolledBack"
+	eventRollbackFailed   = "RollbackFailed"
+	eventCleanupFailed    = "CleanupFailed"
+	eventCleanupStalled   = "CleanupStalled"
+	eventCleanupSucceeded = "CleanupSucceeded"
+	eventDriftDetected    = "DriftDetected"
+	eventForceFinalized   = "ForceFinalized"
+)
+
+const (
+	// eventDedupWindow is how long a Warning Event is not recorded again with the same reason and message.
+	eventDedupWindow = 10 * time.Minute
+	// eventBurst is the number of Events an App can record at once, refilled by one every eventRefillInterval.
+	eventBurst          = 20
+	eventRefillInterval = 30 * time.Second
+	// maxTrackedEvents is the number of Warning Events or Apps tracked above which the expired ones are forgotten.
+	maxTrackedEvents = 1024
+)
+
+// eventf records an Event on the App. It does nothing when the reconciler has no recorder, e.g. in tests,
+// or when the Event is dropped by the event limiter.
+func (r *AppReconciler) eventf(app *aloysv1.App, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	message := fmt.Sprintf(messageFmt, args...)
+	if !r.events.allow(app.UID, eventType, reason, message, time.Now()) {
+		return
+	}
+	r.Recorder.Event(app, eventType, reason, message)
+}
+
+// warningf records a Warning Event on the App.
+func (r *AppReconciler) warningf(app *aloysv1.App, reason, messageFmt string, args ...interface{}) {
+	r.eventf(app, corev1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+// eventLimiter keeps an App failing on every reconcile from flooding its namespace with Events:
+// a Warning Event is recorded once per eventDedupWindow, and a token bucket per App limits the
+// rate of all its Events. The zero value is ready to use.
+// client-go 的 EventCorrelator 只合并完全相同的 Event，错误信息中带有变化的内容时仍然会产生大量 Event
+type eventLimiter struct {
+	mu sync.Mutex
+	// warnings 记录每个 Warning Event 上一次记录的时间
+	warnings map[eventKey]time.Time
+	buckets  map[types.UID]*rate.Limiter
+}
+
+type eventKey struct {
+	uid     types.UID
+	reason  string
+	message string
+}
+
+// allow reports whether an Event of the App with the given UID may be recorded at now.
+func (l *eventLimiter) allow(uid types.UID, eventType, reason, message string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.warnings == nil {
+		l.warnings = map[eventKey]time.Time{}
+		l.buckets = map[types.UID]*rate.Limiter{}
+	}
+	key := eventKey{uid: uid, reason: reason, message: message}
+	if last, ok := l.warnings[key]; ok && eventType == corev1.EventTypeWarning && now.Sub(last) < eventDedupWindow {
+		return false
+	}
+	bucket, ok := l.buckets[uid]
+	if !ok {
+		bucket = rate.NewLimiter(rate.Every(eventRefillInterval), eventBurst)
+		l.buckets[uid] = bucket
+	}
+	if !bucket.AllowN(now, 1) {
+		return false
+	}
+	if eventType == corev1.EventTypeWarning {
+		l.warnings[key] = now
+	}
+	if len(l.warnings) > maxTrackedEvents || len(l.buckets) > maxTrackedEvents {
+		l.forgetExpired(now)
+	}
+	return true
+}
+
+// forgetExpired drops the Warning Events recorded before the dedup window and the token buckets
+// that are full again, so the limiter does not keep growing with the Apps that were deleted.
+func (l *eventLimiter) forgetExpired(now time.Time) {
+	for key, last := range l.warnings {
+		if now.Sub(last) >= eventDedupWindow {
+			delete(l.warnings, key)
+		}
+	}
+	for uid, bucket := range l.buckets {
+		if bucket.TokensAt(now) >= eventBurst {
+			delete(l.buckets, uid)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// reconcileExternalResources ensures and observes the resource of every registered provider and
+// records the IDs the providers assigned in children.externalResources.
+// ID 保存在 status 中，下一次 Reconcile 以及删除 App 时通过它找到对应的外部资源
+//
+// A new ID is written to the status as soon as Ensure returns it, before the resource is observed,
+// so a later error cannot make the next reconcile create the resource a second time. The entries
+// of the providers that are no longer registered are kept, their resources are left as they are.
+func (r *AppReconciler) reconcileExternalResources(ctx context.Context, app *aloysv1.App, children *appChildren) error {
+	logger := log.FromContext(ctx)
+
+	for _, p := range r.Providers.Providers() {
+		id := ""
+		if prev := findExternalResource(children.externalResources, p.Name()); prev != nil {
+			id = prev.ID
+		}
+		newID, err := p.Ensure(ctx, app, id)
+		if err != nil {
+			return fmt.Errorf("unable to ensure the external resource of provider %q: %w", p.Name(), err)
+		}
+		if newID != id {
+			logger.Info("ensured external resource", "provider", p.Name(), "id", newID)
+			setExternalResource(&children.externalResources, aloysv1.ExternalResourceStatus{Provider: p.Name(), ID: newID})
+			if err := r.recordExternalResources(ctx, app, children.externalResources); err != nil {
+				return fmt.Errorf("unable to record the external resource %s of provider %q: %w", newID, p.Name(), err)
+			}
+		}
+		obs, err := p.Observe(ctx, app, newID)
+		if err != nil {
+			return fmt.Errorf("unable to observe the external resource of provider %q: %w", p.Name(), err)
+		}
+		setExternalResource(&children.externalResources, aloysv1.ExternalResourceStatus{
+			Provider: p.Name(),
+			ID:       newID,
+			Ready:    obs.Exists && obs.Ready,
+			Message:  obs.Message,
+		})
+	}
+	for _, res := range children.externalResources {
+		if _, ok := r.Providers.Get(res.Provider); !ok {
+			// provider 已经不再注册，无法管理这个资源，保留 status 中的记录，重新注册后继续管理或在删除 App 时清理
+			logger.Info("external resource provider is not registered, keeping its resource", "provider", res.Provider, "id", res.ID)
+		}
+	}
+	return nil
+}
+
+// recordExternalResources writes the external resources to the status of the App right away.
+func (r *AppReconciler) recordExternalResources(ctx context.Context, app *aloysv1.App, resources []aloysv1.ExternalResourceStatus) error {
+	status := app.Status.DeepCopy()
+	status.ExternalResources = append([]aloysv1.ExternalResourceStatus(nil), resources...)
+	return r.patchStatus(ctx, app, status)
+}
+
+// deleteExternalResources deletes the external resources recorded in the status of the App.
+// Providers must treat deleting a missing resource as a success, so this is safe to retry.
+func (r *AppReconciler) deleteExternalResources(ctx context.Context, app *aloysv1.App) error {
+	logger := log.FromContext(ctx)
+
+	for _, res := range app.Status.ExternalResources {
+		p, ok := r.Providers.Get(res.Provider)
+		if !ok {
+			logger.Info("external resource provider is not registered, leaving its resource", "provider", res.Provider, "id", res.ID)
+			continue
+		}
+		if err := p.Delete(ctx, app, res.ID); err != nil {
+			return fmt.Errorf("unable to delete the external resource %s of provider %q: %w", res.ID, res.Provider, err)
+		}
+		logger.Info("deleted external resource", "provider", res.Provider, "id", res.ID)
+	}
+	return nil
+}
+
+func findExternalResource(resources []aloysv1.ExternalResourceStatus, provider string) *aloysv1.ExternalResourceStatus {
+	for i := range resources {
+		if resources[i].Provider == provider {
+			return &resources[i]
+		}
+	}
+	return nil
+}
+
+// setExternalResource replaces the entry of the provider of res, or appends res when there is none.
+func setExternalResource(resources *[]aloysv1.ExternalResourceStatus, res aloysv1.ExternalResourceStatus) {
+	if prev := findExternalResource(*resources, res.Provider); prev != nil {
+		*prev = res
+		return
+	}
+	*resources = append(*resources, res)
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+	"kubebuilder-demo1/internal/config"
+)
+
+// Waiting reasons of a container that make a rollout fail.
+const (
+	reasonCrashLoopBackOff = "CrashLoopBackOff"
+	reasonImagePullBackOff = "ImagePullBackOff"
+)
+
+// workloadFailure describes why the workload of an App is failing.
+type workloadFailure struct {
+	reason  string
+	message string
+}
+
+// checkWorkload inspects the Deployments and pods of the App and returns the first failure found:
+// a Deployment that exceeded its progress deadline, or a container in CrashLoopBackOff or ImagePullBackOff.
+// 只检查 Pod 当前的状态，不记录历史，Pod 恢复正常后 failure 随之消失
+func (r *AppReconciler) checkWorkload(ctx context.Context, app *aloysv1.App, children *appChildren) (*workloadFailure, error) {
+	for _, deploy := range []*appsv1.Deployment{children.deployment, children.canaryDeployment, children.previewDeployment} {
+		if deploy == nil {
+			continue
+		}
+		if rollout := deploymentRollout(deploy); rollout.deadlineExceeded {
+			return &workloadFailure{reason: reasonProgressDeadlineExceeded, message: rollout.message}, nil
+		}
+	}
+
+	// 按各个 Deployment 的 selector 检查 Pod，stable 和 canary 的 Pod 不会重复检查
+	for _, deploy := range []*appsv1.Deployment{children.deployment, children.canaryDeployment, children.previewDeployment} {
+		if deploy == nil {
+			continue
+		}
+		failure, err := r.checkPods(ctx, deploy)
+		if failure != nil || err != nil {
+			return failure, err
+		}
+	}
+	return nil, nil
+}
+
+// checkPods returns the first failing container of the pods selected by the Deployment.
+func (r *AppReconciler) checkPods(ctx context.Context, deploy *appsv1.Deployment) (*workloadFailure, error) {
+	selector, err := metav1.LabelSelectorAsSelector(deploy.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+	// 旧版本创建的 stable Deployment 的 selector 没有 track 标签，也会选中 canary 的 Pod，这里排除掉
+	if _, ok := deploy.Spec.Selector.MatchLabels[trackLabelKey]; !ok {
+		req, err := labels.NewRequirement(trackLabelKey, selection.NotEquals, []string{trackCanary})
+		if err != nil {
+			return nil, err
+		}
+		selector = selector.Add(*req)
+	}
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(deploy.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+	// 按名称排序，多个 Pod 同时失败时 status 中的信息保持稳定
+	sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		for _, cs := range pod.Status.ContainerStatuses {
+			if failure := containerFailure(pod, cs); failure != nil {
+				return failure, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// containerFailure returns the failure of a container, or nil when it is not failing.
+func containerFailure(pod *corev1.Pod, cs corev1.ContainerStatus) *workloadFailure {
+	waiting := cs.State.Waiting
+	if waiting == nil {
+		return nil
+	}
+	switch waiting.Reason {
+	case reasonCrashLoopBackOff:
+		msg := fmt.Sprintf("container %q of pod %q is in CrashLoopBackOff", cs.Name, pod.Name)
+		// 容器上一次退出时写入 terminationMessagePath 的内容通常就是失败的原因
+		if t := cs.LastTerminationState.Terminated; t != nil {
+			msg += fmt.Sprintf(", last terminated with exit code %d (%s)", t.ExitCode, t.Reason)
+			if m := strings.TrimSpace(t.Message); m != "" {
+				msg += ": " + m
+			}
+		}
+		return &workloadFailure{reason: reasonCrashLoopBackOff, message: msg}
+	case reasonImagePullBackOff:
+		// ErrImagePull 可能只是镜像仓库短暂不可用，kubelet 重试仍然失败后才变为 ImagePullBackOff
+		msg := fmt.Sprintf("container %q of pod %q cannot pull image %q", cs.Name, pod.Name, cs.Image)
+		if waiting.Message != "" {
+			msg += ": " + waiting.Message
+		}
+		return &workloadFailure{reason: reasonImagePullBackOff, message: msg}
+	}
+	return nil
+}
+
+// autoRollback reverts the workload spec of the App to its last healthy revision when the
+// current revision is failing while it is being rolled out. Nothing is done when the current
+// revision is the last healthy one, or once its rollout completed, e.g. when the pods of a running
+// App start crashing, since there is nothing better to go back to.
+// 回滚后只有 spec 发生变化，旧版本按照正常的发布流程重新发布
+func (r *AppReconciler) autoRollback(ctx context.Context, app *aloysv1.App, children *appChildren) error {
+	logger := log.FromContext(ctx)
+	if !r.Config.FeatureEnabled(config.FeatureAutoRollback) || !rolloutInProgress(app, children) {
+		return nil
+	}
+
+	failure, current := children.failure, children.revision
+	healthy := app.Status.LastHealthyRevision
+	if failure == nil || current == nil || healthy == "" || healthy == current.Name {
+		return nil
+	}
+	rev := &appsv1.ControllerRevision{}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: app.Namespace, Name: healthy}, rev); err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		logger.Info("last healthy revision is gone, not rolling back", "controllerRevision", healthy)
+		return nil
+	}
+	orig := app.DeepCopy()
+	if err := restoreRevision(app, rev); err != nil {
+		return err
+	}
+	if err := r.patchAppSpec(ctx, orig, app); err != nil {
+		return err
+	}
+	logger.Info("rollout failed, rolled back to the last healthy revision",
+		"reason", failure.reason, "failedRevision", current.Name, "controllerRevision", rev.Name)
+	r.warningf(app, eventRolledBack, "Rollout of %s failed (%s), rolled back to %s: %s", current.Name, failure.reason, rev.Name, failure.message)
+	recordRollout(rolloutRolledBack)
+	children.rollback = &aloysv1.RollbackStatus{
+		FailedRevision: current.Name,
+		Revision:       rev.Name,
+		Reason:         failure.reason,
+		Message:        failure.message,
+		Time:           metav1.Now(),
+	}
+	return nil
+}
+
+// rolloutInProgress reports whether the current revision of the App is still being rolled out:
+// the Deployment has not finished its rollout or exceeded its progress deadline, or a canary or
+// blue/green rollout is running.
+func rolloutInProgress(app *aloysv1.App, children *appChildren) bool {
+	return !deploymentRollout(children.deployment).complete || strategyState(app, children).active
+}
+
+// PodCacheSelector selects the pods of the Apps. The manager only caches the pods it matches,
+// so watching the pods does not keep every pod of the cluster in memory.
+func PodCacheSelector() labels.Selector {
+	req, err := labels.NewRequirement(appLabelKey, selection.Exists, nil)
+	if err != nil {
+		panic(err)
+	}
+	return labels.NewSelector().Add(*req)
+}
+
+// appForPod maps a pod to the App it belongs to through the app label.
+// Pod 的 owner 是 ReplicaSet，不能通过 Owns 监听，只能根据标签找到对应的 App
+func appForPod(ctx context.Context, obj client.Object) []reconcile.Request {
+	name, ok := obj.GetLabels()[appLabelKey]
+	if !ok {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	autoscalingv2ac "k8s.io/client-go/applyconfigurations/autoscaling/v2"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// reconcileHPA applies the HorizontalPodAutoscaler of the App, or deletes it when spec.autoscaling is not set.
+// target is the name of the Deployment scaled by the HorizontalPodAutoscaler.
+func (r *AppReconciler) reconcileHPA(ctx context.Context, app *aloysv1.App, children *appChildren, target string) (*autoscalingv2.HorizontalPodAutoscaler, error) {
+	logger := log.FromContext(ctx)
+
+	if app.Spec.Autoscaling == nil {
+		return nil, r.deleteOwned(ctx, app, &autoscalingv2.HorizontalPodAutoscaler{}, types.NamespacedName{Namespace: app.Namespace, Name: app.Name})
+	}
+
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{}
+	owned, err := getOwned(ctx, r.Client, types.NamespacedName{Namespace: app.Namespace, Name: app.Name}, hpa, autoscalingv2ac.ExtractHorizontalPodAutoscaler)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := &autoscalingv2.HorizontalPodAutoscaler{ObjectMeta: metav1.ObjectMeta{Name: app.Name, Namespace: app.Namespace}}
+	mutateHPA(app, desired, target)
+	if err := ctrl.SetControllerReference(app, desired, r.Scheme); err != nil {
+		return nil, err
+	}
+	config := autoscalingv2ac.HorizontalPodAutoscaler(app.Name, app.Namespace)
+	if err := toApplyConfiguration(desired, config); err != nil {
+		return nil, err
+	}
+	config.Status = nil
+
+	applied, err := r.applyObject(ctx, app, children, hpa, config, owned)
+	if err != nil {
+		return nil, err
+	}
+	if applied {
+		logger.Info("applied horizontalpodautoscaler", "horizontalpodautoscaler", hpa.Name)
+	}
+	return hpa, nil
+}
+
+// mutateHPA sets the fields of the HorizontalPodAutoscaler that are driven by the App spec.
+func mutateHPA(app *aloysv1.App, hpa *autoscalingv2.HorizontalPodAutoscaler, target string) {
+	if hpa.Labels == nil {
+		hpa.Labels = map[string]string{}
+	}
+	for k, v := range appLabels(app) {
+		hpa.Labels[k] = v
+	}
+
+	spec := app.Spec.Autoscaling
+	// HPA 直接作用于 App 生成的 Deployment
+	hpa.Spec.ScaleTargetRef = autoscalingv2.CrossVersionObjectReference{
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       target,
+	}
+	hpa.Spec.MinReplicas = ptr.To(ptr.Deref(spec.MinReplicas, 1))
+	hpa.Spec.MaxReplicas = spec.MaxReplicas
+
+	var metrics []autoscalingv2.MetricSpec
+	if spec.TargetCPUUtilizationPercentage != nil {
+		metrics = append(metrics, resourceMetric(corev1.ResourceCPU, *spec.TargetCPUUtilizationPercentage))
+	}
+	if spec.TargetMemoryUtilizationPercentage != nil {
+		metrics = append(metrics, resourceMetric(corev1.ResourceMemory, *spec.TargetMemoryUtilizationPercentage))
+	}
+	metrics = append(metrics, spec.Metrics...)
+	// 没有指定任何指标时 apiserver 会默认使用 80% 的 CPU 利用率，这里显式写出来
+	if len(metrics) == 0 {
+		metrics = append(metrics, resourceMetric(corev1.ResourceCPU, 80))
+	}
+	hpa.Spec.Metrics = metrics
+}
+
+// resourceMetric returns a metric targeting the average utilization of a resource.
+func resourceMetric(name corev1.ResourceName, utilization int32) autoscalingv2.MetricSpec {
+	return autoscalingv2.MetricSpec{
+		Type: autoscalingv2.ResourceMetricSourceType,
+		Resource: &autoscalingv2.ResourceMetricSource{
+			Name: name,
+			Target: autoscalingv2.MetricTarget{
+				Type:               autoscalingv2.UtilizationMetricType,
+				AverageUtilization: ptr.To(utilization),
+			},
+		},
+	}
+}
+
+// autoscalingStatus returns the replica counts reported by the HorizontalPodAutoscaler.
+func autoscalingStatus(hpa *autoscalingv2.HorizontalPodAutoscaler) *aloysv1.AutoscalingStatus {
+	if hpa == nil {
+		return nil
+	}
+	return &aloysv1.AutoscalingStatus{
+		CurrentReplicas: hpa.Status.CurrentReplicas,
+		DesiredReplicas: hpa.Status.DesiredReplicas,
+	}
+}
+
+// initialReplicas returns the replica count of a newly created Deployment when autoscaling is enabled:
+// spec.replicas clamped to the bounds of the HorizontalPodAutoscaler.
+func initialReplicas(app *aloysv1.App) int32 {
+	replicas := ptr.Deref(app.Spec.Replicas, 1)
+	spec := app.Spec.Autoscaling
+	if minReplicas := ptr.Deref(spec.MinReplicas, 1); replicas < minReplicas {
+		replicas = minReplicas
+	}
+	if replicas > spec.MaxReplicas {
+		replicas = spec.MaxReplicas
+	}
+	return replicas
+}
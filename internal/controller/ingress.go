@@ -0,0 +1,191 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	networkingv1ac "k8s.io/client-go/applyconfigurations/networking/v1"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// reconcileIngress applies the Ingress of the App, or deletes it when spec.ingress is not set.
+func (r *AppReconciler) reconcileIngress(ctx context.Context, app *aloysv1.App, children *appChildren) (*networkingv1.Ingress, error) {
+	logger := log.FromContext(ctx)
+
+	if app.Spec.Ingress == nil {
+		return nil, r.deleteOwned(ctx, app, &networkingv1.Ingress{}, types.NamespacedName{Namespace: app.Namespace, Name: app.Name})
+	}
+	// CRD 的 CEL 规则已经保证了这一点，这里再检查一次，避免旧对象导致空指针
+	if app.Spec.Service == nil {
+		return nil, fmt.Errorf("spec.ingress requires spec.service")
+	}
+
+	ing := &networkingv1.Ingress{}
+	owned, err := getOwned(ctx, r.Client, types.NamespacedName{Namespace: app.Namespace, Name: app.Name}, ing, networkingv1ac.ExtractIngress)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: app.Name, Namespace: app.Namespace}}
+	if err := mutateIngress(app, desired); err != nil {
+		return nil, err
+	}
+	if err := ctrl.SetControllerReference(app, desired, r.Scheme); err != nil {
+		return nil, err
+	}
+	config := networkingv1ac.Ingress(app.Name, app.Namespace)
+	if err := toApplyConfiguration(desired, config); err != nil {
+		return nil, err
+	}
+	config.Status = nil
+
+	applied, err := r.applyObject(ctx, app, children, ing, config, owned)
+	if err != nil {
+		return nil, err
+	}
+	if applied {
+		logger.Info("applied ingress", "ingress", ing.Name)
+	}
+	return ing, nil
+}
+
+// mutateIngress sets the fields of the Ingress that are driven by the App spec.
+func mutateIngress(app *aloysv1.App, ing *networkingv1.Ingress) error {
+	if ing.Labels == nil {
+		ing.Labels = map[string]string{}
+	}
+	for k, v := range appLabels(app) {
+		ing.Labels[k] = v
+	}
+
+	// 默认转发到 Service 的第一个端口
+	ports := servicePorts(app)
+	if len(ports) == 0 {
+		return fmt.Errorf("spec.ingress requires the Service to expose at least one port")
+	}
+	defaultPort := ports[0].Port
+
+	spec := app.Spec.Ingress
+	ing.Spec.IngressClassName = spec.IngressClassName
+	ing.Spec.Rules = make([]networkingv1.IngressRule, 0, len(spec.Hosts))
+	hosts := make([]string, 0, len(spec.Hosts))
+	for _, h := range spec.Hosts {
+		hosts = append(hosts, h.Host)
+		paths := make([]networkingv1.HTTPIngressPath, 0, len(h.Paths))
+		for _, p := range ingressPaths(h) {
+			port := p.Port
+			if port == 0 {
+				port = defaultPort
+			}
+			paths = append(paths, networkingv1.HTTPIngressPath{
+				Path:     p.Path,
+				PathType: p.PathType,
+				Backend: networkingv1.IngressBackend{
+					Service: &networkingv1.IngressServiceBackend{
+						Name: app.Name,
+						Port: networkingv1.ServiceBackendPort{Number: port},
+					},
+				},
+			})
+		}
+		ing.Spec.Rules = append(ing.Spec.Rules, networkingv1.IngressRule{
+			Host: h.Host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{Paths: paths},
+			},
+		})
+	}
+
+	ing.Spec.TLS = nil
+	for _, t := range ingressTLS(spec) {
+		tlsHosts := t.Hosts
+		if len(tlsHosts) == 0 {
+			tlsHosts = hosts
+		}
+		ing.Spec.TLS = append(ing.Spec.TLS, networkingv1.IngressTLS{Hosts: tlsHosts, SecretName: t.SecretName})
+	}
+	return nil
+}
+
+// ingressTLS returns the TLS certificates of the Ingress, including the one set through the deprecated tlsSecretName.
+func ingressTLS(spec *aloysv1.IngressSpec) []aloysv1.IngressTLS {
+	tls := spec.TLS
+	if spec.TLSSecretName != "" {
+		tls = append([]aloysv1.IngressTLS{{SecretName: spec.TLSSecretName}}, tls...)
+	}
+	return tls
+}
+
+// hostHasTLS reports whether a certificate covers the host.
+func hostHasTLS(spec *aloysv1.IngressSpec, host string) bool {
+	for _, t := range ingressTLS(spec) {
+		if len(t.Hosts) == 0 {
+			return true
+		}
+		for _, h := range t.Hosts {
+			if h == host {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ingressPaths returns the paths of a host with defaults applied.
+func ingressPaths(h aloysv1.IngressHost) []aloysv1.IngressPath {
+	if len(h.Paths) == 0 {
+		return []aloysv1.IngressPath{{Path: "/", PathType: ptr.To(networkingv1.PathTypePrefix)}}
+	}
+	paths := make([]aloysv1.IngressPath, 0, len(h.Paths))
+	for _, p := range h.Paths {
+		if p.Path == "" {
+			p.Path = "/"
+		}
+		if p.PathType == nil {
+			p.PathType = ptr.To(networkingv1.PathTypePrefix)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+// ingressURLs returns the URLs the App is reachable at through its Ingress.
+func ingressURLs(app *aloysv1.App) []string {
+	if app.Spec.Ingress == nil {
+		return nil
+	}
+	var urls []string
+	for _, h := range app.Spec.Ingress.Hosts {
+		scheme := "http"
+		if hostHasTLS(app.Spec.Ingress, h.Host) {
+			scheme = "https"
+		}
+		for _, p := range ingressPaths(h) {
+			urls = append(urls, fmt.Sprintf("%s://%s%s", scheme, h.Host, p.Path))
+		}
+	}
+	return urls
+}
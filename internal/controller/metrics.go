@@ -0,0 +1,173 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+	"kubebuilder-demo1/internal/tracing"
+)
+
+// Phases of a reconcile, the values of the phase label of app_reconcile_phase_duration_seconds.
+const (
+	phaseRevision          = "revision"
+	phaseWorkload          = "workload"
+	phaseService           = "service"
+	phaseIngress           = "ingress"
+	phaseAutoscaling       = "autoscaling"
+	phaseExternalResources = "external_resources"
+	phaseHealth            = "health"
+	phaseStatus            = "status"
+	phaseCleanup           = "cleanup"
+)
+
+// Outcomes of a rollout, the values of the outcome label of app_rollout_total.
+const (
+	rolloutStarted    = "started"
+	rolloutSucceeded  = "succeeded"
+	rolloutAborted    = "aborted"
+	rolloutRolledBack = "rolled_back"
+)
+
+// Results of a finalizer cleanup, the values of the result label of app_finalizer_cleanup_duration_seconds.
+const (
+	cleanupSucceeded = "succeeded"
+	cleanupForced    = "forced"
+)
+
+// 这些指标和 controller-runtime 自带的指标一起注册在 metrics.Registry 中，由 manager 的 metrics server 通过 /metrics 暴露
+var (
+	appReady = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "app_ready",
+		Help: "Whether the App is ready (1) or not (0).",
+	}, []string{"namespace", "name"})
+
+	appReplicasDesired = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "app_replicas_desired",
+		Help: "Number of replicas the App should be running, as set by spec.replicas or its HorizontalPodAutoscaler.",
+	}, []string{"namespace", "name"})
+
+	appReplicasAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "app_replicas_available",
+		Help: "Number of available replicas serving the App.",
+	}, []string{"namespace", "name"})
+
+	reconcilePhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "app_reconcile_phase_duration_seconds",
+		Help:    "Duration of the phases of the reconcile of an App.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"phase"})
+
+	finalizerCleanupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "app_finalizer_cleanup_duration_seconds",
+		Help: "Time from the deletion of an App to the removal of its finalizer.",
+		// 从 1 秒到大约 1 小时，超过 CleanupTimeout 的清理落在最后几个桶中
+		Buckets: prometheus.ExponentialBuckets(1, 2, 13),
+	}, []string{"result"})
+
+	rolloutTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "app_rollout_total",
+		Help: "Number of rollouts of the Apps by outcome.",
+	}, []string{"outcome"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		appReady,
+		appReplicasDesired,
+		appReplicasAvailable,
+		reconcilePhaseDuration,
+		finalizerCleanupDuration,
+		rolloutTotal,
+	)
+}
+
+// tracer records the spans of the reconciles and of their phases.
+var tracer = tracing.Tracer("kubebuilder-demo1/internal/controller")
+
+// runPhase runs a phase of the reconcile in its own span and records its duration in
+// app_reconcile_phase_duration_seconds.
+func runPhase(ctx context.Context, phase string, fn func(ctx context.Context) error) (err error) {
+	ctx, span := tracer.Start(ctx, phase)
+	defer func(start time.Time) {
+		reconcilePhaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}(time.Now())
+	return fn(ctx)
+}
+
+// recordRollout counts a rollout with the given outcome in app_rollout_total.
+func recordRollout(outcome string) {
+	rolloutTotal.WithLabelValues(outcome).Inc()
+}
+
+// recordCleanup records how long the cleanup of a deleted App took until its finalizer is removed.
+func recordCleanup(app *aloysv1.App, result string) {
+	if app.DeletionTimestamp == nil {
+		return
+	}
+	finalizerCleanupDuration.WithLabelValues(result).Observe(time.Since(app.DeletionTimestamp.Time).Seconds())
+}
+
+// recordAppMetrics updates the gauges of the App from whether it is ready and from its children.
+func recordAppMetrics(app *aloysv1.App, ready bool, children *appChildren) {
+	readyValue := 0.0
+	if ready {
+		readyValue = 1
+	}
+	appReady.WithLabelValues(app.Namespace, app.Name).Set(readyValue)
+	appReplicasDesired.WithLabelValues(app.Namespace, app.Name).Set(float64(desiredReplicas(app, children)))
+
+	// blue/green 的预览颜色不接收流量，不计入可用副本数；canary 接收一部分流量，计入可用副本数
+	available := int32(0)
+	for _, d := range []*appsv1.Deployment{children.deployment, children.canaryDeployment} {
+		if d != nil {
+			available += d.Status.AvailableReplicas
+		}
+	}
+	appReplicasAvailable.WithLabelValues(app.Namespace, app.Name).Set(float64(available))
+}
+
+// desiredReplicas returns the number of replicas the App should be running.
+func desiredReplicas(app *aloysv1.App, children *appChildren) int32 {
+	if app.Spec.Autoscaling == nil {
+		return ptr.Deref(app.Spec.Replicas, 1)
+	}
+	// HPA 还没有计算出副本数时使用 Deployment 当前的副本数
+	if children.hpa != nil && children.hpa.Status.DesiredReplicas > 0 {
+		return children.hpa.Status.DesiredReplicas
+	}
+	if children.deployment != nil && children.deployment.Spec.Replicas != nil {
+		return *children.deployment.Spec.Replicas
+	}
+	return initialReplicas(app)
+}
+
+// forgetAppMetrics removes the series of a deleted App, so it does not keep reporting its last state.
+func forgetAppMetrics(key types.NamespacedName) {
+	for _, g := range []*prometheus.GaugeVec{appReady, appReplicasDesired, appReplicasAvailable} {
+		g.DeleteLabelValues(key.Namespace, key.Name)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// patchApp applies mutate to the App and sends the change as a merge patch carrying the
+// resourceVersion, so a concurrent change of the App is never overwritten. On a conflict the App is
+// read again and mutate is applied to the latest version, so mutate must only depend on the App it
+// is given, e.g. adding a finalizer or removing an annotation.
+// 和 Update 相比只发送修改的字段，也不会覆盖 status
+func (r *AppReconciler) patchApp(ctx context.Context, app *aloysv1.App, mutate func(app *aloysv1.App)) error {
+	first := true
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if !first {
+			// 冲突后直接从 apiserver 读取，缓存可能还没有收到最新的版本，重试会一直冲突
+			if err := r.apiReader().Get(ctx, client.ObjectKeyFromObject(app), app); err != nil {
+				return err
+			}
+		}
+		first = false
+		patch := client.MergeFromWithOptions(app.DeepCopy(), client.MergeFromWithOptimisticLock{})
+		mutate(app)
+		return r.Patch(ctx, app, patch)
+	})
+}
+
+// patchAppSpec sends the changes made to the spec of the App since orig as a merge patch carrying
+// the resourceVersion. Unlike patchApp it does not retry: the change was computed from the state of
+// the App, e.g. a rollback, so a conflict is returned and the App is reconciled again from scratch.
+func (r *AppReconciler) patchAppSpec(ctx context.Context, orig, app *aloysv1.App) error {
+	return r.Patch(ctx, app, client.MergeFromWithOptions(orig, client.MergeFromWithOptimisticLock{}))
+}
+
+// patchStatus writes the status of the App through the status subresource as a merge patch.
+// The patch does not carry the resourceVersion: the status is only written by this controller and
+// a reconcile never runs concurrently for the same App, so a change of the spec or the metadata
+// since the App was read must not make the status write fail.
+func (r *AppReconciler) patchStatus(ctx context.Context, app *aloysv1.App, status *aloysv1.AppStatus) error {
+	patch := client.MergeFrom(app.DeepCopy())
+	app.Status = *status
+	return r.Status().Patch(ctx, app, patch)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+const (
+	// revisionHashLabelKey 记录 ControllerRevision 中 workload spec 的 hash，用来判断当前 spec 是否已经有对应的 revision
+	revisionHashLabelKey = "aloys.tech/revision-hash"
+
+	defaultRevisionHistoryLimit = 10
+)
+
+// workloadSpec returns the part of the App spec that is recorded in a revision: the fields
+// making up the pod template. Replicas, the Service, the Ingress and the rollout strategy are
+// not part of a revision, so a rollback does not undo a scale-out or a routing change.
+func workloadSpec(spec *aloysv1.AppSpec) *aloysv1.AppSpec {
+	out := &aloysv1.AppSpec{}
+	copyWorkloadSpec(spec, out)
+	return out
+}
+
+// copyWorkloadSpec copies the fields recorded in a revision from src to dst.
+func copyWorkloadSpec(src, dst *aloysv1.AppSpec) {
+	src = src.DeepCopy()
+	dst.Image = src.Image
+	dst.ImagePullPolicy = src.ImagePullPolicy
+	dst.ImagePullSecrets = src.ImagePullSecrets
+	dst.Ports = src.Ports
+	dst.Env = src.Env
+	dst.EnvFrom = src.EnvFrom
+	dst.Volumes = src.Volumes
+	dst.VolumeMounts = src.VolumeMounts
+	dst.Resources = src.Resources
+	dst.LivenessProbe = src.LivenessProbe
+	dst.ReadinessProbe = src.ReadinessProbe
+	dst.Command = src.Command
+	dst.Args = src.Args
+}
+
+// reconcileRevision records the current workload spec of the App in a ControllerRevision and
+// trims the history to spec.revisionHistoryLimit. It returns the current revision.
+// 和 StatefulSet 一样：spec 回到某个旧的 revision 时，复用这个 ControllerRevision 并把它的编号改为最新
+func (r *AppReconciler) reconcileRevision(ctx context.Context, app *aloysv1.App) (*appsv1.ControllerRevision, error) {
+	logger := log.FromContext(ctx)
+
+	data, err := json.Marshal(workloadSpec(&app.Spec))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])[:10]
+
+	revisions, err := r.listRevisions(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	var next int64 = 1
+	if len(revisions) > 0 {
+		next = revisions[len(revisions)-1].Revision + 1
+	}
+
+	current := findRevision(revisions, func(rev *appsv1.ControllerRevision) bool {
+		return rev.Labels[revisionHashLabelKey] == hash
+	})
+	switch {
+	case current == nil:
+		current = &appsv1.ControllerRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      app.Name + "-" + hash,
+				Namespace: app.Namespace,
+				Labels:    appLabels(app),
+			},
+			Data:     runtime.RawExtension{Raw: data},
+			Revision: next,
+		}
+		current.Labels[revisionHashLabelKey] = hash
+		if err := ctrl.SetControllerReference(app, current, r.Scheme); err != nil {
+			return nil, err
+		}
+		if err := r.Create(ctx, current); err != nil {
+			return nil, err
+		}
+		logger.Info("recorded new revision", "revision", current.Revision, "controllerRevision", current.Name)
+		r.eventf(app, corev1.EventTypeNormal, eventRolloutStarted, "Rolling out revision %d with the %s strategy", current.Revision, strategyName(app))
+		recordRollout(rolloutStarted)
+		revisions = append(revisions, current)
+	case current.Revision != next-1:
+		// ControllerRevision 的 data 不可修改，只更新编号
+		patch := client.MergeFrom(current.DeepCopy())
+		current.Revision = next
+		if err := r.Patch(ctx, current, patch); err != nil {
+			return nil, err
+		}
+		logger.Info("workload spec matches an old revision, renumbered it", "revision", current.Revision, "controllerRevision", current.Name)
+		r.eventf(app, corev1.EventTypeNormal, eventRolloutStarted, "Rolling out revision %d, matching the earlier %s, with the %s strategy",
+			current.Revision, current.Name, strategyName(app))
+		recordRollout(rolloutStarted)
+		sortRevisions(revisions)
+	}
+
+	// 清理超出 revisionHistoryLimit 的旧 revision，当前 revision 不计入限制，最后一个健康的 revision 用于自动回滚，也不会被清理
+	limit := int(ptr.Deref(app.Spec.RevisionHistoryLimit, defaultRevisionHistoryLimit))
+	old := len(revisions) - 1
+	for _, rev := range revisions {
+		if old <= limit {
+			break
+		}
+		if rev.Name == current.Name || rev.Name == app.Status.LastHealthyRevision {
+			continue
+		}
+		if err := r.Delete(ctx, rev); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		logger.Info("deleted old revision", "revision", rev.Revision, "controllerRevision", rev.Name)
+		old--
+	}
+	return current, nil
+}
+
+// rollback restores the workload spec of the revision requested in spec.rollbackTo and clears the field.
+// 回滚通过修改 App 的 spec 实现，之后按照正常的发布流程(包括 canary 和 blue/green)发布旧版本
+func (r *AppReconciler) rollback(ctx context.Context, app *aloysv1.App) error {
+	logger := log.FromContext(ctx)
+
+	revisions, err := r.listRevisions(ctx, app)
+	if err != nil {
+		return err
+	}
+	target := app.Spec.RollbackTo.Revision
+	if target == 0 {
+		// 0 表示回滚到当前 revision 的上一个
+		for _, rev := range revisions {
+			if rev.Revision < app.Status.CurrentRevision {
+				target = rev.Revision
+			}
+		}
+	}
+	rev := findRevision(revisions, func(rev *appsv1.ControllerRevision) bool {
+		return target != 0 && rev.Revision == target
+	})
+
+	orig := app.DeepCopy()
+	app.Spec.RollbackTo = nil
+	if rev == nil {
+		// 找不到对应的 revision 时只清除 rollbackTo，不修改 spec
+		logger.Error(fmt.Errorf("revision %d not found", target), "unable to roll back", "currentRevision", app.Status.CurrentRevision)
+	} else {
+		if err := restoreRevision(app, rev); err != nil {
+			return err
+		}
+		logger.Info("rolling back", "revision", rev.Revision, "controllerRevision", rev.Name)
+	}
+	if err := r.patchAppSpec(ctx, orig, app); err != nil {
+		return err
+	}
+	if rev == nil {
+		r.warningf(app, eventRollbackFailed, "Revision %d of spec.rollbackTo not found, the App was not rolled back", target)
+	} else {
+		r.eventf(app, corev1.EventTypeNormal, eventRolledBack, "Rolled back to revision %d as requested by spec.rollbackTo", rev.Revision)
+	}
+	return nil
+}
+
+// strategyName returns the name of the rollout strategy of the App used in Events.
+func strategyName(app *aloysv1.App) string {
+	switch {
+	case isCanary(app):
+		return "canary"
+	case isBlueGreen(app):
+		return "blue/green"
+	default:
+		return "rolling update"
+	}
+}
+
+// restoreRevision copies the workload spec recorded in a revision into the App spec.
+func restoreRevision(app *aloysv1.App, rev *appsv1.ControllerRevision) error {
+	spec := &aloysv1.AppSpec{}
+	if err := json.Unmarshal(rev.Data.Raw, spec); err != nil {
+		return fmt.Errorf("unable to decode revision %d: %w", rev.Revision, err)
+	}
+	copyWorkloadSpec(spec, &app.Spec)
+	return nil
+}
+
+// listRevisions returns the ControllerRevisions owned by the App, sorted by revision number.
+func (r *AppReconciler) listRevisions(ctx context.Context, app *aloysv1.App) ([]*appsv1.ControllerRevision, error) {
+	list := &appsv1.ControllerRevisionList{}
+	if err := r.List(ctx, list, client.InNamespace(app.Namespace), client.MatchingLabels(selectorLabels(app))); err != nil {
+		return nil, err
+	}
+	var revisions []*appsv1.ControllerRevision
+	for i := range list.Items {
+		if metav1.IsControlledBy(&list.Items[i], app) {
+			revisions = append(revisions, &list.Items[i])
+		}
+	}
+	sortRevisions(revisions)
+	return revisions, nil
+}
+
+func sortRevisions(revisions []*appsv1.ControllerRevision) {
+	sort.SliceStable(revisions, func(i, j int) bool {
+		return revisions[i].Revision < revisions[j].Revision
+	})
+}
+
+func findRevision(revisions []*appsv1.ControllerRevision, match func(*appsv1.ControllerRevision) bool) *appsv1.ControllerRevision {
+	for _, rev := range revisions {
+		if match(rev) {
+			return rev
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1ac "k8s.io/client-go/applyconfigurations/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// reconcileService creates or updates the Service of the App, or deletes it when spec.service is not set.
+// selector selects the pods receiving the traffic, in blue/green mode only the pods of the active color.
+func (r *AppReconciler) reconcileService(ctx context.Context, app *aloysv1.App, children *appChildren, selector map[string]string) (*corev1.Service, error) {
+	if app.Spec.Service == nil {
+		// spec.service 被移除，删除之前创建的 Service
+		return nil, r.deleteOwned(ctx, app, &corev1.Service{}, types.NamespacedName{Namespace: app.Namespace, Name: app.Name})
+	}
+	return r.applyService(ctx, app, children, app.Name, app.Spec.Service.Type, selector)
+}
+
+// applyService applies a Service of the App with the given name, type and selector with server-side apply.
+func (r *AppReconciler) applyService(ctx context.Context, app *aloysv1.App, children *appChildren, name string, svcType corev1.ServiceType, selector map[string]string) (*corev1.Service, error) {
+	svc := &corev1.Service{}
+	owned, err := getOwned(ctx, r.Client, types.NamespacedName{Namespace: app.Namespace, Name: name}, svc, corev1ac.ExtractService)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: app.Namespace}}
+	mutateService(app, desired, svcType, selector)
+	if err := ctrl.SetControllerReference(app, desired, r.Scheme); err != nil {
+		return nil, err
+	}
+	config := corev1ac.Service(name, app.Namespace)
+	if err := toApplyConfiguration(desired, config); err != nil {
+		return nil, err
+	}
+	config.Status = nil
+
+	applied, err := r.applyObject(ctx, app, children, svc, config, owned)
+	if err != nil {
+		return nil, err
+	}
+	if applied {
+		log.FromContext(ctx).Info("applied service", "service", svc.Name)
+	}
+	return svc, nil
+}
+
+// mutateService sets the fields of the Service that are driven by the App spec.
+func mutateService(app *aloysv1.App, svc *corev1.Service, svcType corev1.ServiceType, selector map[string]string) {
+	if svc.Labels == nil {
+		svc.Labels = map[string]string{}
+	}
+	for k, v := range appLabels(app) {
+		svc.Labels[k] = v
+	}
+	if len(app.Spec.Service.Annotations) > 0 && svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+	for k, v := range app.Spec.Service.Annotations {
+		svc.Annotations[k] = v
+	}
+
+	svc.Spec.Type = svcType
+	if svc.Spec.Type == "" {
+		svc.Spec.Type = corev1.ServiceTypeClusterIP
+	}
+	svc.Spec.Selector = selector
+	svc.Spec.Ports = servicePorts(app)
+}
+
+// servicePorts returns the desired ports of the App's Service, with the protocol and the targetPort
+// defaulted. The nodePort allocated by the apiserver is not owned by the controller and is kept.
+func servicePorts(app *aloysv1.App) []corev1.ServicePort {
+	desired := app.Spec.Service.Ports
+	if len(desired) == 0 {
+		// 没有指定端口时，将容器的所有端口按相同的端口号暴露出去
+		for _, p := range app.Spec.Ports {
+			desired = append(desired, corev1.ServicePort{
+				Name:       p.Name,
+				Protocol:   p.Protocol,
+				Port:       p.ContainerPort,
+				TargetPort: intstr.FromInt32(p.ContainerPort),
+			})
+		}
+	}
+
+	ports := make([]corev1.ServicePort, 0, len(desired))
+	for _, p := range desired {
+		if p.Protocol == "" {
+			p.Protocol = corev1.ProtocolTCP
+		}
+		if p.TargetPort.IntVal == 0 && p.TargetPort.StrVal == "" {
+			p.TargetPort = intstr.FromInt32(p.Port)
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+// deleteOwned deletes the object with the given key if it exists and is controlled by the App.
+// 只删除 App 自己创建的对象，避免误删用户手动创建的同名资源
+func (r *AppReconciler) deleteOwned(ctx context.Context, app *aloysv1.App, obj client.Object, key types.NamespacedName) error {
+	if err := r.Get(ctx, key, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, app) {
+		return nil
+	}
+	gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+	if err != nil {
+		return err
+	}
+	log.FromContext(ctx).Info("deleting child resource", "kind", gvk.Kind, "name", obj.GetName())
+	if err := r.Delete(ctx, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	r.eventf(app, corev1.EventTypeNormal, eventDeleted, "Deleted %s %s", gvk.Kind, obj.GetName())
+	return nil
+}
@@ -0,0 +1,333 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// Reasons used in the conditions of an App.
+const (
+	reasonAvailable                = "Available"
+	reasonRollingOut               = "RollingOut"
+	reasonReconcileError           = "ReconcileError"
+	reasonProgressDeadlineExceeded = "ProgressDeadlineExceeded"
+	reasonAsExpected               = "AsExpected"
+	reasonCanaryRollout            = "CanaryRollout"
+	reasonCanaryAborted            = "CanaryAborted"
+	reasonBlueGreenRollout         = "BlueGreenRollout"
+	reasonRolledBack               = "RolledBack"
+	reasonPaused                   = "Paused"
+)
+
+// updateStatus recomputes the status of the App from the state of its children and
+// patches it through the status subresource when it changed.
+// reconcileErr 是本次 Reconcile 过程中产生的错误，会体现在 Degraded condition 中
+func (r *AppReconciler) updateStatus(ctx context.Context, app *aloysv1.App, children *appChildren, reconcileErr error) error {
+	status := app.Status.DeepCopy()
+	computeStatus(app, status, children, reconcileErr)
+	recordAppMetrics(app, meta.IsStatusConditionTrue(status.Conditions, aloysv1.ConditionReady), children)
+	if equality.Semantic.DeepEqual(status, &app.Status) {
+		return nil
+	}
+	prevHealthy := app.Status.LastHealthyRevision
+	if err := r.patchStatus(ctx, app, status); err != nil {
+		return err
+	}
+	// revision 第一次完整发布并且健康时记为一次成功的发布，status 写入成功之后再计数，避免重复计数
+	if status.LastHealthyRevision != "" && status.LastHealthyRevision != prevHealthy {
+		recordRollout(rolloutSucceeded)
+	}
+	return nil
+}
+
+// updatePausedStatus surfaces the Paused condition of a paused App. The other conditions are
+// left as they were, since the children are not reconciled while the App is paused, but the
+// gauges are refreshed from the Deployments that keep running.
+func (r *AppReconciler) updatePausedStatus(ctx context.Context, app *aloysv1.App) error {
+	children, err := r.observeChildren(ctx, app)
+	if err != nil {
+		return err
+	}
+	// 暂停期间没有重新计算 Ready condition，直接按照 Deployment 是否完整发布判断
+	recordAppMetrics(app, deploymentRollout(children.deployment).complete, children)
+
+	status := app.Status.DeepCopy()
+	msg := "reconciliation is paused by spec.paused"
+	if app.Annotations[aloysv1.AnnotationPaused] == "true" {
+		msg = fmt.Sprintf("reconciliation is paused by the %s annotation", aloysv1.AnnotationPaused)
+	}
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               aloysv1.ConditionPaused,
+		Status:             metav1.ConditionTrue,
+		Reason:             reasonPaused,
+		Message:            msg,
+		ObservedGeneration: app.Generation,
+	})
+	if equality.Semantic.DeepEqual(status, &app.Status) {
+		return nil
+	}
+	return r.patchStatus(ctx, app, status)
+}
+
+// observeChildren reads the Deployments and the HorizontalPodAutoscaler of the App without changing them.
+func (r *AppReconciler) observeChildren(ctx context.Context, app *aloysv1.App) (*appChildren, error) {
+	children := &appChildren{}
+	stable, preview := app.Name, ""
+	if st := app.Status.BlueGreen; isBlueGreen(app) && st != nil && st.ActiveColor != "" {
+		stable = colorName(app, st.ActiveColor)
+		if st.PreviewColor != "" {
+			preview = colorName(app, st.PreviewColor)
+		}
+	}
+	var err error
+	if children.deployment, err = r.getDeployment(ctx, app, stable); err != nil {
+		return nil, err
+	}
+	if preview != "" {
+		if children.previewDeployment, err = r.getDeployment(ctx, app, preview); err != nil {
+			return nil, err
+		}
+	}
+	if isCanary(app) {
+		if children.canaryDeployment, err = r.getCanary(ctx, app); err != nil {
+			return nil, err
+		}
+	}
+	if app.Spec.Autoscaling != nil {
+		hpa := &autoscalingv2.HorizontalPodAutoscaler{}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: app.Namespace, Name: app.Name}, hpa); err == nil {
+			children.hpa = hpa
+		} else if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	}
+	return children, nil
+}
+
+// isPaused reports whether the reconciliation of the App is paused.
+func isPaused(app *aloysv1.App) bool {
+	return app.Spec.Paused || app.Annotations[aloysv1.AnnotationPaused] == "true"
+}
+
+// computeStatus fills the conditions, phase and observed generation of status.
+// status 的每个字段都由子资源的当前状态重新计算，而不是在各个步骤中累加修改
+func computeStatus(app *aloysv1.App, status *aloysv1.AppStatus, children *appChildren, reconcileErr error) {
+	deploy := children.deployment
+	status.ObservedGeneration = app.Generation
+	// 恢复之后不再保留 Paused condition
+	meta.RemoveStatusCondition(&status.Conditions, aloysv1.ConditionPaused)
+	status.URLs = ingressURLs(app)
+	// scale 子资源通过 status.replicas 和 status.selector 读取当前副本数和 Pod 的 selector，HPA 依赖这两个字段
+	status.Selector = metav1.FormatLabelSelector(&metav1.LabelSelector{MatchLabels: selectorLabels(app)})
+	status.Replicas, status.ReadyReplicas = 0, 0
+	if deploy != nil {
+		status.Replicas = deploy.Status.Replicas
+		status.ReadyReplicas = deploy.Status.ReadyReplicas
+	}
+	for _, d := range []*appsv1.Deployment{children.canaryDeployment, children.previewDeployment} {
+		if d != nil {
+			status.Replicas += d.Status.Replicas
+			status.ReadyReplicas += d.Status.ReadyReplicas
+		}
+	}
+	status.Autoscaling = autoscalingStatus(children.hpa)
+	status.Canary = children.canaryStatus
+	status.BlueGreen = children.blueGreenStatus
+	if children.revision != nil {
+		status.CurrentRevision = children.revision.Revision
+	}
+	status.ExternalResources = children.externalResources
+	status.Drift = driftStatus(status.Drift, children.drift, reconcileErr != nil)
+	if children.rollback != nil {
+		status.LastRollback = children.rollback
+	}
+
+	setCondition := func(condType string, condStatus metav1.ConditionStatus, reason, message string) {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               condType,
+			Status:             condStatus,
+			Reason:             reason,
+			Message:            message,
+			ObservedGeneration: app.Generation,
+		})
+	}
+
+	rollout := deploymentRollout(deploy)
+
+	degraded, degradedReason, degradedMessage := false, reasonAsExpected, ""
+	switch {
+	case reconcileErr != nil:
+		degraded, degradedReason, degradedMessage = true, reasonReconcileError, reconcileErr.Error()
+	case children.failure != nil:
+		degraded, degradedReason, degradedMessage = true, children.failure.reason, children.failure.message
+	case rollout.deadlineExceeded:
+		degraded, degradedReason, degradedMessage = true, reasonProgressDeadlineExceeded, rollout.message
+	}
+	// 自动回滚之后旧版本可以正常提供服务，但在 spec 再次变化之前一直通过 Degraded 提示发布失败的原因
+	rolledBack := false
+	if rb := status.LastRollback; !degraded && rb != nil && children.revision != nil && children.revision.Name == rb.Revision {
+		rolledBack = true
+		setCondition(aloysv1.ConditionDegraded, metav1.ConditionTrue, rb.Reason,
+			fmt.Sprintf("rolled back from revision %s to %s: %s", rb.FailedRevision, rb.Revision, rb.Message))
+	} else if degraded {
+		setCondition(aloysv1.ConditionDegraded, metav1.ConditionTrue, degradedReason, degradedMessage)
+	} else {
+		setCondition(aloysv1.ConditionDegraded, metav1.ConditionFalse, degradedReason, "")
+	}
+
+	strategy := strategyState(app, children)
+	// 完整发布并且没有失败的 revision 记为最后一个健康的 revision，发布失败时回滚到它
+	if rollout.complete && !degraded && !strategy.active && !strategy.aborted && children.revision != nil {
+		status.LastHealthyRevision = children.revision.Name
+	}
+
+	switch {
+	case strategy.active && !degraded:
+		// canary 或 blue/green 过程中旧版本继续提供服务，Ready 取决于旧版本的状态
+		readyStatus, readyReason := metav1.ConditionFalse, reasonRollingOut
+		if rollout.complete {
+			readyStatus, readyReason = metav1.ConditionTrue, reasonAvailable
+		}
+		setCondition(aloysv1.ConditionReady, readyStatus, readyReason, rollout.message)
+		setCondition(aloysv1.ConditionProgressing, metav1.ConditionTrue, strategy.reason, strategy.message)
+	case strategy.aborted && rollout.complete && !degraded:
+		setCondition(aloysv1.ConditionReady, metav1.ConditionTrue, reasonAvailable, rollout.message)
+		setCondition(aloysv1.ConditionProgressing, metav1.ConditionFalse, strategy.reason, strategy.message)
+	case rollout.complete && !degraded:
+		setCondition(aloysv1.ConditionReady, metav1.ConditionTrue, reasonAvailable, rollout.message)
+		setCondition(aloysv1.ConditionProgressing, metav1.ConditionFalse, reasonAvailable, "")
+	case degraded:
+		setCondition(aloysv1.ConditionReady, metav1.ConditionFalse, degradedReason, degradedMessage)
+		setCondition(aloysv1.ConditionProgressing, metav1.ConditionFalse, degradedReason, "")
+	default:
+		setCondition(aloysv1.ConditionReady, metav1.ConditionFalse, reasonRollingOut, rollout.message)
+		setCondition(aloysv1.ConditionProgressing, metav1.ConditionTrue, reasonRollingOut, rollout.message)
+	}
+
+	switch {
+	case degraded || rolledBack:
+		status.Phase = aloysv1.AppPhaseDegraded
+	case strategy.active:
+		status.Phase = aloysv1.AppPhaseProgressing
+	case rollout.complete:
+		status.Phase = aloysv1.AppPhaseRunning
+	case rollout.available == 0:
+		status.Phase = aloysv1.AppPhasePending
+	default:
+		status.Phase = aloysv1.AppPhaseProgressing
+	}
+}
+
+// rolloutState summarizes the rollout of a Deployment.
+type rolloutState struct {
+	complete         bool
+	deadlineExceeded bool
+	available        int32
+	message          string
+}
+
+// deploymentRollout inspects the status of a Deployment the same way `kubectl rollout status` does.
+func deploymentRollout(deploy *appsv1.Deployment) rolloutState {
+	if deploy == nil {
+		return rolloutState{message: "Deployment has not been created yet"}
+	}
+	st := rolloutState{available: deploy.Status.AvailableReplicas}
+	desired := ptr.Deref(deploy.Spec.Replicas, 1)
+
+	if deploy.Status.ObservedGeneration < deploy.Generation {
+		st.message = "waiting for the Deployment spec update to be observed"
+		return st
+	}
+	for _, c := range deploy.Status.Conditions {
+		if c.Type == appsv1.DeploymentProgressing && c.Status == corev1.ConditionFalse && c.Reason == "ProgressDeadlineExceeded" {
+			st.deadlineExceeded = true
+			st.message = fmt.Sprintf("Deployment %q exceeded its progress deadline", deploy.Name)
+			return st
+		}
+	}
+	switch {
+	case deploy.Status.UpdatedReplicas < desired:
+		st.message = fmt.Sprintf("%d out of %d new replicas have been updated", deploy.Status.UpdatedReplicas, desired)
+	case deploy.Status.Replicas > deploy.Status.UpdatedReplicas:
+		st.message = fmt.Sprintf("%d old replicas are pending termination", deploy.Status.Replicas-deploy.Status.UpdatedReplicas)
+	case deploy.Status.AvailableReplicas < deploy.Status.UpdatedReplicas:
+		st.message = fmt.Sprintf("%d of %d updated replicas are available", deploy.Status.AvailableReplicas, deploy.Status.UpdatedReplicas)
+	default:
+		st.complete = true
+		st.message = fmt.Sprintf("%d of %d replicas are available", deploy.Status.AvailableReplicas, desired)
+	}
+	return st
+}
+
+// strategyRollout summarizes the state of a canary or blue/green rollout.
+type strategyRollout struct {
+	active  bool
+	aborted bool
+	reason  string
+	message string
+}
+
+// strategyState inspects the canary or blue/green status of an App.
+func strategyState(app *aloysv1.App, children *appChildren) strategyRollout {
+	if isBlueGreen(app) {
+		return blueGreenState(children.blueGreenStatus, children.previewDeployment)
+	}
+	return canaryState(app, children.canaryStatus)
+}
+
+// canaryState inspects the canary status of an App.
+func canaryState(app *aloysv1.App, st *aloysv1.CanaryStatus) strategyRollout {
+	switch {
+	case st == nil || st.Promoted || !isCanary(app):
+		return strategyRollout{}
+	case st.Aborted:
+		return strategyRollout{aborted: true, reason: reasonCanaryAborted, message: fmt.Sprintf("canary of revision %s was aborted", st.Revision)}
+	}
+	steps := len(app.Spec.Strategy.Canary.Steps)
+	msg := fmt.Sprintf("canary of revision %s at step %d of %d with weight %d%%", st.Revision, st.CurrentStep+1, steps, st.Weight)
+	if int(st.CurrentStep) < steps && st.StepStartedAt != nil && app.Spec.Strategy.Canary.Steps[st.CurrentStep].Pause == nil {
+		msg += fmt.Sprintf(", waiting for the %s annotation", aloysv1.AnnotationCanaryPromote)
+	}
+	return strategyRollout{active: true, reason: reasonCanaryRollout, message: msg}
+}
+
+// blueGreenState inspects the blue/green status of an App. The rollout is active while
+// the preview color runs a new revision that has not been switched to yet.
+func blueGreenState(st *aloysv1.BlueGreenStatus, preview *appsv1.Deployment) strategyRollout {
+	if st == nil || st.PreviewColor == "" || st.ScaleDownAt != nil {
+		return strategyRollout{}
+	}
+	msg := fmt.Sprintf("revision %s is rolling out to the preview color %s", st.PreviewRevision, st.PreviewColor)
+	if preview != nil {
+		msg += ": " + deploymentRollout(preview).message
+	}
+	return strategyRollout{active: true, reason: reasonBlueGreenRollout, message: msg}
+}
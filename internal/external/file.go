@@ -0,0 +1,113 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package external
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// FileProvider is a reference provider storing one JSON file per App in a directory.
+// It shows how a real backend maps onto ExternalResourceProvider: the ID is derived from the
+// App UID, Ensure only writes when the content changed, and Delete ignores missing files.
+type FileProvider struct {
+	name string
+	dir  string
+}
+
+// fileResource is the content of the file of an App.
+type fileResource struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Image     string `json:"image"`
+}
+
+var _ ExternalResourceProvider = &FileProvider{}
+
+// NewFileProvider returns a provider storing its resources in dir. The directory is created if needed.
+func NewFileProvider(name, dir string) (*FileProvider, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create the directory of provider %q: %w", name, err)
+	}
+	return &FileProvider{name: name, dir: dir}, nil
+}
+
+// Name implements ExternalResourceProvider.
+func (p *FileProvider) Name() string {
+	return p.name
+}
+
+// Ensure implements ExternalResourceProvider.
+func (p *FileProvider) Ensure(_ context.Context, app *aloysv1.App, id string) (string, error) {
+	if id == "" {
+		// 使用 App 的 UID 作为 ID，同名的 App 被删除后重新创建时不会复用旧的文件
+		id = string(app.UID)
+	}
+	data, err := json.MarshalIndent(fileResource{ID: id, Namespace: app.Namespace, Name: app.Name, Image: app.Spec.Image}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := p.path(id)
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return id, nil
+	}
+	// 先写临时文件再重命名，避免读到写了一半的文件
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Observe implements ExternalResourceProvider.
+func (p *FileProvider) Observe(_ context.Context, _ *aloysv1.App, id string) (Observation, error) {
+	data, err := os.ReadFile(p.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Observation{Message: fmt.Sprintf("file of resource %s does not exist", id)}, nil
+	}
+	if err != nil {
+		return Observation{}, err
+	}
+	res := fileResource{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return Observation{Exists: true, Message: fmt.Sprintf("file of resource %s is corrupted: %v", id, err)}, nil
+	}
+	return Observation{Exists: true, Ready: true, Message: fmt.Sprintf("resource %s stored in %s", id, p.path(id))}, nil
+}
+
+// Delete implements ExternalResourceProvider.
+func (p *FileProvider) Delete(_ context.Context, _ *aloysv1.App, id string) error {
+	if err := os.Remove(p.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (p *FileProvider) path(id string) string {
+	return filepath.Join(p.dir, filepath.Base(id)+".json")
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package external
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// MemoryProvider keeps the external resources in memory. It is meant for tests and local runs:
+// the resources are lost when the manager restarts and are recreated by the next reconcile.
+type MemoryProvider struct {
+	name string
+
+	mu        sync.Mutex
+	nextID    int
+	resources map[string]memoryResource
+}
+
+type memoryResource struct {
+	app   string
+	image string
+}
+
+var _ ExternalResourceProvider = &MemoryProvider{}
+
+// NewMemoryProvider returns an empty in-memory provider with the given name.
+func NewMemoryProvider(name string) *MemoryProvider {
+	return &MemoryProvider{name: name, resources: map[string]memoryResource{}}
+}
+
+// Name implements ExternalResourceProvider.
+func (p *MemoryProvider) Name() string {
+	return p.name
+}
+
+// Ensure implements ExternalResourceProvider.
+func (p *MemoryProvider) Ensure(_ context.Context, app *aloysv1.App, id string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.resources[id]; id == "" || !ok {
+		// 第一次创建或者资源已经丢失(比如 manager 重启)，分配新的 ID
+		p.nextID++
+		id = fmt.Sprintf("%s-%d", p.name, p.nextID)
+	}
+	p.resources[id] = memoryResource{app: app.Namespace + "/" + app.Name, image: app.Spec.Image}
+	return id, nil
+}
+
+// Observe implements ExternalResourceProvider.
+func (p *MemoryProvider) Observe(_ context.Context, _ *aloysv1.App, id string) (Observation, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res, ok := p.resources[id]
+	if !ok {
+		return Observation{Message: fmt.Sprintf("resource %s does not exist", id)}, nil
+	}
+	return Observation{Exists: true, Ready: true, Message: fmt.Sprintf("resource %s of %s runs %s", id, res.app, res.image)}, nil
+}
+
+// Delete implements ExternalResourceProvider.
+func (p *MemoryProvider) Delete(_ context.Context, _ *aloysv1.App, id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.resources, id)
+	return nil
+}
+
+// Len returns the number of resources held by the provider.
+func (p *MemoryProvider) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.resources)
+}
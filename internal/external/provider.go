@@ -0,0 +1,109 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package external defines the providers managing resources outside the cluster on behalf of an App,
+// e.g. DNS records or buckets, and ships an in-memory and a file-backed reference implementation.
+package external
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+// ExternalResourceProvider manages one resource outside the cluster for each App.
+// The reconciler calls Ensure and Observe on every reconcile of an App and Delete when the App
+// is deleted, unless its deletion policy is Orphan. Every method must be idempotent.
+// 实现新的后端(比如云 DNS 或对象存储)只需要实现这个接口并注册，不需要修改 reconciler
+type ExternalResourceProvider interface {
+	// Name identifies the provider. It is recorded in the App status next to the resource ID.
+	Name() string
+	// Ensure creates or updates the resource of the App. id is the ID returned by a previous call,
+	// or empty when the resource has not been created yet. It returns the ID of the resource.
+	Ensure(ctx context.Context, app *aloysv1.App, id string) (string, error)
+	// Observe returns the current state of the resource with the given ID.
+	Observe(ctx context.Context, app *aloysv1.App, id string) (Observation, error)
+	// Delete deletes the resource with the given ID. Deleting a resource that does not exist is not an error.
+	Delete(ctx context.Context, app *aloysv1.App, id string) error
+}
+
+// Observation is the state of an external resource.
+type Observation struct {
+	// Exists is false when the resource is missing, e.g. deleted outside of the controller.
+	Exists bool
+	// Ready is true when the resource can be used by the App.
+	Ready bool
+	// Message describes the state of the resource.
+	Message string
+}
+
+// Registry holds the providers the reconciler calls for every App.
+type Registry struct {
+	mu        sync.RWMutex
+	providers map[string]ExternalResourceProvider
+}
+
+// NewRegistry returns a registry holding the given providers.
+func NewRegistry(providers ...ExternalResourceProvider) *Registry {
+	r := &Registry{providers: map[string]ExternalResourceProvider{}}
+	for _, p := range providers {
+		if err := r.Register(p); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// Register adds a provider to the registry. Provider names must be unique.
+func (r *Registry) Register(p ExternalResourceProvider) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.providers[p.Name()]; ok {
+		return fmt.Errorf("external resource provider %q is already registered", p.Name())
+	}
+	r.providers[p.Name()] = p
+	return nil
+}
+
+// Get returns the provider with the given name.
+func (r *Registry) Get(name string) (ExternalResourceProvider, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// Providers returns the registered providers sorted by name. A nil registry has no provider.
+func (r *Registry) Providers() []ExternalResourceProvider {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]ExternalResourceProvider, 0, len(r.providers))
+	for _, p := range r.providers {
+		out = append(out, p)
+	}
+	// 按名称排序，status 中的顺序保持稳定
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package external
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	aloysv1 "kubebuilder-demo1/api/v1"
+)
+
+var _ = Describe("External resource providers", func() {
+	ctx := context.Background()
+	var app *aloysv1.App
+
+	BeforeEach(func() {
+		app = &aloysv1.App{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "0c8c5a0e-uid"},
+			Spec:       aloysv1.AppSpec{Image: "nginx:1.25"},
+		}
+	})
+
+	// 每个 provider 都要满足同样的约定：Ensure 幂等、Observe 能发现资源丢失、Delete 可以重复执行
+	for _, tc := range []struct {
+		name string
+		new  func() ExternalResourceProvider
+	}{
+		{name: "memory", new: func() ExternalResourceProvider { return NewMemoryProvider("memory") }},
+		{name: "file", new: func() ExternalResourceProvider {
+			p, err := NewFileProvider("file", GinkgoT().TempDir())
+			Expect(err).NotTo(HaveOccurred())
+			return p
+		}},
+	} {
+		Context("with the "+tc.name+" provider", func() {
+			var p ExternalResourceProvider
+
+			BeforeEach(func() {
+				p = tc.new()
+			})
+
+			It("should keep the ID of an existing resource", func() {
+				id, err := p.Ensure(ctx, app, "")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(id).NotTo(BeEmpty())
+
+				app.Spec.Image = "nginx:1.26"
+				again, err := p.Ensure(ctx, app, id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(again).To(Equal(id))
+
+				obs, err := p.Observe(ctx, app, id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obs.Exists).To(BeTrue())
+				Expect(obs.Ready).To(BeTrue())
+			})
+
+			It("should report deleted resources and delete them idempotently", func() {
+				id, err := p.Ensure(ctx, app, "")
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(p.Delete(ctx, app, id)).To(Succeed())
+				Expect(p.Delete(ctx, app, id)).To(Succeed())
+
+				obs, err := p.Observe(ctx, app, id)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(obs.Exists).To(BeFalse())
+			})
+		})
+	}
+
+	It("should refuse to register two providers with the same name", func() {
+		r := NewRegistry(NewMemoryProvider("a"), NewMemoryProvider("b"))
+		Expect(r.Register(NewMemoryProvider("a"))).NotTo(Succeed())
+		Expect(r.Providers()).To(HaveLen(2))
+		Expect(r.Providers()[0].Name()).To(Equal("a"))
+
+		var nilRegistry *Registry
+		Expect(nilRegistry.Providers()).To(BeEmpty())
+	})
+})
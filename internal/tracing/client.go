@@ -0,0 +1,167 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+)
+
+// clientTracerName is the name of the tracer of the spans of the API calls.
+const clientTracerName = "kubebuilder-demo1/internal/tracing/client"
+
+// Attributes of the spans of the API calls.
+const (
+	attrKind        = attribute.Key("k8s.kind")
+	attrNamespace   = attribute.Key("k8s.namespace")
+	attrName        = attribute.Key("k8s.name")
+	attrSubresource = attribute.Key("k8s.subresource")
+)
+
+// WrapClient returns a client that records a span for every call to the API server made through c.
+// 读操作通常命中 informer 的缓存，同样记录 span，这样可以看出一次 Reconcile 在哪些调用上花费了时间
+func WrapClient(c client.Client) client.Client {
+	return &tracingClient{Client: c}
+}
+
+type tracingClient struct {
+	client.Client
+}
+
+func (c *tracingClient) start(ctx context.Context, verb string, obj runtime.Object, key client.ObjectKey) (context.Context, trace.Span) {
+	return startSpan(ctx, c.Scheme(), verb, obj, key, "")
+}
+
+func (c *tracingClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) (err error) {
+	ctx, span := c.start(ctx, "Get", obj, key)
+	defer func() { End(span, err) }()
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func (c *tracingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) (err error) {
+	listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+	ctx, span := c.start(ctx, "List", list, client.ObjectKey{Namespace: listOpts.Namespace})
+	defer func() { End(span, err) }()
+	return c.Client.List(ctx, list, opts...)
+}
+
+func (c *tracingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) (err error) {
+	ctx, span := c.start(ctx, "Create", obj, client.ObjectKeyFromObject(obj))
+	defer func() { End(span, err) }()
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) (err error) {
+	ctx, span := c.start(ctx, "Delete", obj, client.ObjectKeyFromObject(obj))
+	defer func() { End(span, err) }()
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func (c *tracingClient) DeleteAllOf(ctx context.Context, obj client.Object, opts ...client.DeleteAllOfOption) (err error) {
+	ctx, span := c.start(ctx, "DeleteAllOf", obj, client.ObjectKey{Namespace: obj.GetNamespace()})
+	defer func() { End(span, err) }()
+	return c.Client.DeleteAllOf(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) (err error) {
+	ctx, span := c.start(ctx, "Update", obj, client.ObjectKeyFromObject(obj))
+	defer func() { End(span, err) }()
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func (c *tracingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) (err error) {
+	ctx, span := c.start(ctx, patchVerb(patch), obj, client.ObjectKeyFromObject(obj))
+	defer func() { End(span, err) }()
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func (c *tracingClient) Status() client.SubResourceWriter {
+	return c.SubResource("status")
+}
+
+func (c *tracingClient) SubResource(subResource string) client.SubResourceClient {
+	return &tracingSubResourceClient{SubResourceClient: c.Client.SubResource(subResource), scheme: c.Scheme(), subResource: subResource}
+}
+
+type tracingSubResourceClient struct {
+	client.SubResourceClient
+	scheme      *runtime.Scheme
+	subResource string
+}
+
+func (c *tracingSubResourceClient) start(ctx context.Context, verb string, obj client.Object) (context.Context, trace.Span) {
+	return startSpan(ctx, c.scheme, verb, obj, client.ObjectKeyFromObject(obj), c.subResource)
+}
+
+func (c *tracingSubResourceClient) Get(ctx context.Context, obj, subResource client.Object, opts ...client.SubResourceGetOption) (err error) {
+	ctx, span := c.start(ctx, "Get", obj)
+	defer func() { End(span, err) }()
+	return c.SubResourceClient.Get(ctx, obj, subResource, opts...)
+}
+
+func (c *tracingSubResourceClient) Create(ctx context.Context, obj, subResource client.Object, opts ...client.SubResourceCreateOption) (err error) {
+	ctx, span := c.start(ctx, "Create", obj)
+	defer func() { End(span, err) }()
+	return c.SubResourceClient.Create(ctx, obj, subResource, opts...)
+}
+
+func (c *tracingSubResourceClient) Update(ctx context.Context, obj client.Object, opts ...client.SubResourceUpdateOption) (err error) {
+	ctx, span := c.start(ctx, "Update", obj)
+	defer func() { End(span, err) }()
+	return c.SubResourceClient.Update(ctx, obj, opts...)
+}
+
+func (c *tracingSubResourceClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.SubResourcePatchOption) (err error) {
+	ctx, span := c.start(ctx, patchVerb(patch), obj)
+	defer func() { End(span, err) }()
+	return c.SubResourceClient.Patch(ctx, obj, patch, opts...)
+}
+
+// startSpan starts the span of an API call, named after the verb and the kind of obj, e.g. "Get Deployment".
+func startSpan(ctx context.Context, scheme *runtime.Scheme, verb string, obj runtime.Object, key client.ObjectKey, subResource string) (context.Context, trace.Span) {
+	kind := "Object"
+	if gvk, err := apiutil.GVKForObject(obj, scheme); err == nil {
+		kind = strings.TrimSuffix(gvk.Kind, "List")
+	}
+	name := verb + " " + kind
+	attrs := []attribute.KeyValue{attrKind.String(kind)}
+	if key.Namespace != "" {
+		attrs = append(attrs, attrNamespace.String(key.Namespace))
+	}
+	if key.Name != "" {
+		attrs = append(attrs, attrName.String(key.Name))
+	}
+	if subResource != "" {
+		name += "/" + subResource
+		attrs = append(attrs, attrSubresource.String(subResource))
+	}
+	return Tracer(clientTracerName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// patchVerb distinguishes server-side apply from the other patches.
+func patchVerb(patch client.Patch) string {
+	if patch.Type() == client.Apply.Type() {
+		return "Apply"
+	}
+	return "Patch"
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// collectorStub is an in-process OTLP collector recording the spans it receives.
+type collectorStub struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	mu       sync.Mutex
+	spans    []string
+	services []string
+}
+
+func (c *collectorStub) Export(_ context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.record(req)
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+// ServeHTTP implements the OTLP/HTTP endpoint with protobuf payloads.
+func (c *collectorStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	req := &collectortrace.ExportTraceServiceRequest{}
+	if err == nil {
+		err = proto.Unmarshal(body, req)
+	}
+	if r.URL.Path != "/v1/traces" || err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	c.record(req)
+	resp, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(resp)
+}
+
+func (c *collectorStub) record(req *collectortrace.ExportTraceServiceRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, attr := range rs.GetResource().GetAttributes() {
+			if attr.Key == "service.name" {
+				c.services = append(c.services, attr.GetValue().GetStringValue())
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				c.spans = append(c.spans, span.Name)
+			}
+		}
+	}
+}
+
+func (c *collectorStub) spanNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.spans...)
+}
+
+var _ = Describe("Tracing", func() {
+	ctx := context.Background()
+	var collector *collectorStub
+
+	BeforeEach(func() {
+		collector = &collectorStub{}
+	})
+
+	// exportSpans records a Reconcile span with a child span, then flushes them to the collector.
+	exportSpans := func(opts Options) {
+		shutdown, err := Setup(ctx, opts)
+		Expect(err).NotTo(HaveOccurred())
+		spanCtx, span := Tracer("test").Start(ctx, "Reconcile")
+		_, child := Tracer("test").Start(spanCtx, "revision")
+		child.End()
+		span.End()
+		Expect(shutdown(ctx)).To(Succeed())
+	}
+
+	It("should export the spans over OTLP/gRPC", func() {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		server := grpc.NewServer()
+		collectortrace.RegisterTraceServiceServer(server, collector)
+		go func() { _ = server.Serve(lis) }()
+		defer server.Stop()
+
+		exportSpans(Options{Endpoint: lis.Addr().String(), Protocol: ProtocolGRPC, Insecure: true, SamplingRatio: 1})
+		Expect(collector.spanNames()).To(ConsistOf("Reconcile", "revision"))
+		Expect(collector.services).To(ContainElement(ServiceName))
+	})
+
+	It("should export the spans over OTLP/HTTP", func() {
+		server := httptest.NewServer(collector)
+		defer server.Close()
+
+		exportSpans(Options{Endpoint: strings.TrimPrefix(server.URL, "http://"), Protocol: ProtocolHTTP, Insecure: true, SamplingRatio: 1})
+		Expect(collector.spanNames()).To(ConsistOf("Reconcile", "revision"))
+	})
+
+	It("should not export the traces that are not sampled", func() {
+		server := httptest.NewServer(collector)
+		defer server.Close()
+
+		exportSpans(Options{Endpoint: strings.TrimPrefix(server.URL, "http://"), Protocol: ProtocolHTTP, Insecure: true, SamplingRatio: 0})
+		Expect(collector.spanNames()).To(BeEmpty())
+	})
+
+	It("should reject invalid options", func() {
+		_, err := Setup(ctx, Options{Endpoint: "localhost:4317", Protocol: "udp", SamplingRatio: 1})
+		Expect(err).To(MatchError(ContainSubstring("unknown tracing protocol")))
+		_, err = Setup(ctx, Options{Endpoint: "localhost:4317", SamplingRatio: 1.5})
+		Expect(err).To(MatchError(ContainSubstring("sampling ratio")))
+
+		By("Leaving tracing disabled without an endpoint")
+		shutdown, err := Setup(ctx, Options{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(shutdown(ctx)).To(Succeed())
+	})
+
+	Context("With a recording TracerProvider", func() {
+		var recorder *tracetest.SpanRecorder
+
+		BeforeEach(func() {
+			recorder = tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		})
+
+		It("should record a child span for every API call", func() {
+			c := WrapClient(fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).Build())
+			spanCtx, span := Tracer("test").Start(ctx, "Reconcile")
+			cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "default"}}
+			Expect(c.Create(spanCtx, cm)).To(Succeed())
+			Expect(c.Get(spanCtx, client.ObjectKeyFromObject(cm), cm)).To(Succeed())
+			Expect(c.List(spanCtx, &corev1.ConfigMapList{}, client.InNamespace("default"))).To(Succeed())
+			patch := client.MergeFrom(cm.DeepCopy())
+			cm.Data = map[string]string{"key": "value"}
+			Expect(c.Patch(spanCtx, cm, patch)).To(Succeed())
+			Expect(c.Get(spanCtx, types.NamespacedName{Name: "missing", Namespace: "default"}, &corev1.ConfigMap{})).NotTo(Succeed())
+			span.End()
+
+			var names []string
+			for _, s := range recorder.Ended() {
+				names = append(names, s.Name())
+				Expect(s.SpanContext().TraceID()).To(Equal(span.SpanContext().TraceID()))
+				if s.Name() == "Get ConfigMap" && s.Status().Code == codes.Error {
+					Expect(s.Attributes()).To(ContainElement(attrName.String("missing")))
+				}
+			}
+			Expect(names).To(Equal([]string{"Create ConfigMap", "Get ConfigMap", "List ConfigMap", "Patch ConfigMap", "Get ConfigMap", "Reconcile"}))
+			Expect(recorder.Ended()[4].Status().Code).To(Equal(codes.Error))
+		})
+
+		It("should add the trace ID to the logger", func() {
+			var lines []string
+			logger := funcr.New(func(prefix, args string) { lines = append(lines, args) }, funcr.Options{})
+
+			LoggerWithTraceID(ctx, logger).Info("no trace")
+			spanCtx, span := Tracer("test").Start(ctx, "Reconcile")
+			defer span.End()
+			LoggerWithTraceID(spanCtx, logger).Info("reconciling")
+
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[0]).NotTo(ContainSubstring("traceID"))
+			Expect(lines[1]).To(ContainSubstring(`"traceID"="` + span.SpanContext().TraceID().String() + `"`))
+		})
+	})
+})